@@ -0,0 +1,303 @@
+//分块上传：大文件分成多个块，每块一个multipart请求上传，全部收到后合并为一个UpFile
+//
+//除文件字段外，请求包含以下参数(在query中，或在multipart中位于文件字段之前):
+//
+//	upload_id    客户端生成的上传id(8-64位字母、数字、-、_)，同一文件的各块相同
+//	chunk_index  块序号，从0开始
+//	chunk_total  块总数
+//	chunk_md5    块内容的md5(可选)，不一致时返回ErrChunkChecksum，客户端应重传该块
+//
+//块保存在upload.path/chunks/<upload_id>/下，每块的大小受upload.max_size限制，合并后的文件受upload.chunk_max_size限制；
+//中断后可用ChunkStatus查询已收到的块，只上传缺少的块，超过upload.chunk_lifetime秒未完成的上传会被清理
+//
+//	func (this *C) Upload() {
+//		uf, err := this.ChunkUpload("file")
+//		switch {
+//		case err != nil:
+//			this.ShowErr(400, err.Error())
+//		case uf == nil: //还有块未上传
+//			this.Resp(`{"received":%d}`, len(this.ChunkStatus()))
+//		case uf.Error != ecgo.UPLOAD_ERR_OK:
+//			this.ShowErr(400, "upload fail")
+//		default:
+//			uf.SaveTo("/data/video")
+//		}
+//	}
+
+package ecgo
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/tim1020/ecgo/util"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//分块上传的参数名
+const (
+	chunkIdParam    = "upload_id"
+	chunkIndexParam = "chunk_index"
+	chunkTotalParam = "chunk_total"
+	chunkMd5Param   = "chunk_md5"
+	maxChunks       = 10000
+)
+
+var reChunkId = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+var (
+	ErrChunkParam    = errors.New("invalid chunk params")
+	ErrChunkChecksum = errors.New("chunk checksum mismatch")
+	ErrChunkTooLarge = errors.New("chunk upload too large")
+)
+
+//上次清理过期分块的时间
+var chunkGcTime int64
+
+//接收一个块，全部块收到后合并，返回合并后的文件(已替换this.UpFile[field])，还有块未收到时返回nil
+//
+//合并后的文件与普通上传一样检查类型(结果在Error中)并保存到存储
+func (this *Request) ChunkUpload(field string) (*UpFile, error) {
+	this.chunkGc()
+	dir, err := this.chunkDir()
+	if err != nil {
+		return nil, err
+	}
+	index, err1 := strconv.Atoi(this.chunkParam(chunkIndexParam))
+	total, err2 := strconv.Atoi(this.chunkParam(chunkTotalParam))
+	if err1 != nil || err2 != nil || total < 1 || total > maxChunks || index < 0 || index >= total {
+		return nil, ErrChunkParam
+	}
+	if len(this.UpFile[field]) == 0 {
+		return nil, fmt.Errorf("%w: no file in field %s", ErrChunkParam, field)
+	}
+	uf := &this.UpFile[field][0]
+	if uf.Error == UPLOAD_ERR_OK { //upload_id在文件字段之后，已作为普通文件处理
+		return nil, fmt.Errorf("%w: %s must precede the file field", ErrChunkParam, chunkIdParam)
+	}
+	if uf.Error != UPLOAD_ERR_CHUNK {
+		return nil, fmt.Errorf("chunk upload fail: error=%d", uf.Error)
+	}
+	if sum := this.chunkParam(chunkMd5Param); sum != "" {
+		if m, err := fileMd5(uf.Temp); err != nil || !strings.EqualFold(m, sum) {
+			return nil, ErrChunkChecksum
+		}
+	}
+	maxSize, _ := strconv.ParseInt(this.Conf["upload.chunk_max_size"], 10, 64)
+	size := uf.Size
+	for i, s := range chunkList(dir) {
+		if i != index {
+			size += s
+		}
+	}
+	if size > maxSize {
+		os.RemoveAll(dir)
+		return nil, ErrChunkTooLarge
+	}
+	if err := os.MkdirAll(dir, uf.dirPerm); err != nil {
+		return nil, err
+	}
+	if err := chunkCheckTotal(dir, total); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(uf.Temp, filepath.Join(dir, strconv.Itoa(index))); err != nil {
+		return nil, err
+	}
+	uf.Temp = ""
+	if uf.Name != "" { //合并时使用的文件名
+		os.WriteFile(filepath.Join(dir, "name"), []byte(uf.Name), 0600)
+	}
+	this.Log.Write(LL_SYS, "[%s]chunk received: id=%s, index=%d, total=%d", this.appId, filepath.Base(dir), index, total)
+	chunks := chunkList(dir)
+	for i := 0; i < total; i++ {
+		if _, exists := chunks[i]; !exists {
+			return nil, nil
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".lock"), 0700); err != nil { //其它请求正在合并
+		return nil, nil
+	}
+	return this.chunkAssemble(dir, total, field, uf), nil
+}
+
+//查询当前upload_id已收到的块序号
+func (this *Request) ChunkStatus() []int {
+	dir, err := this.chunkDir()
+	if err != nil {
+		return nil
+	}
+	var received []int
+	for i := range chunkList(dir) {
+		received = append(received, i)
+	}
+	sort.Ints(received)
+	return received
+}
+
+//合并全部块为一个临时文件，检查类型并保存到存储
+func (this *Request) chunkAssemble(dir string, total int, field string, chunk *UpFile) *UpFile {
+	uf := UpFile{Error: UPLOAD_ERR_OK, Name: chunk.Name, filePerm: chunk.filePerm, dirPerm: chunk.dirPerm}
+	if b, err := os.ReadFile(filepath.Join(dir, "name")); err == nil {
+		uf.Name = string(b)
+	}
+	f, fname, err := newUpTemp(this.Conf, uf.dirPerm)
+	if err != nil {
+		uf.Error = UPLOAD_ERR_TEMP
+	} else {
+		uf.Temp = f.Name()
+		for i := 0; i < total && err == nil; i++ {
+			err = appendFile(f, filepath.Join(dir, strconv.Itoa(i)))
+		}
+		if err == nil {
+			uf.Size, err = f.Seek(0, io.SeekCurrent)
+		}
+		f.Close()
+		if err != nil {
+			uf.Error = UPLOAD_ERR_CANT_WRITE
+			os.Remove(uf.Temp)
+			uf.Temp = ""
+		}
+	}
+	if uf.Error != UPLOAD_ERR_OK { //保留已收到的块，可以重试
+		os.Remove(filepath.Join(dir, ".lock"))
+		this.Log.E("[%s]chunk assemble fail: id=%s, error=%d", this.appId, filepath.Base(dir), uf.Error)
+	} else {
+		os.RemoveAll(dir)
+		head := make([]byte, 512)
+		if f, err := os.Open(uf.Temp); err == nil {
+			n, _ := io.ReadFull(f, head)
+			head = head[:n]
+			f.Close()
+		}
+		if checkUpType(&uf, head, this.Conf) {
+			rule, _ := parseImageRule(this.Conf, field)
+			finishUpFile(&uf, fname, rule, this.Conf, this.uploadStorage())
+		} else {
+			os.Remove(uf.Temp)
+			uf.Temp = ""
+		}
+		this.Log.Write(LL_SYS, "[%s]chunk assembled: id=%s, size=%d, error=%d", this.appId, filepath.Base(dir), uf.Size, uf.Error)
+	}
+	this.UpFile[field] = []UpFile{uf}
+	return &this.UpFile[field][0]
+}
+
+//分块参数，post中没有时从get中读取
+func (this *Request) chunkParam(key string) string {
+	if val := this.Post[key]; val != "" {
+		return val
+	}
+	return this.Get[key]
+}
+
+//当前upload_id的分块目录
+func (this *Request) chunkDir() (string, error) {
+	id := this.chunkParam(chunkIdParam)
+	if !reChunkId.MatchString(id) {
+		return "", fmt.Errorf("%w: %s", ErrChunkParam, chunkIdParam)
+	}
+	return filepath.Join(this.Conf["upload.path"], "chunks", id), nil
+}
+
+//块总数由第一个到达的块保存在total文件中，之后的块须一致，防止用较小的total只合并部分块
+func chunkCheckTotal(dir string, total int) error {
+	name := filepath.Join(dir, "total")
+	tmp, err := os.CreateTemp(dir, ".total")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strconv.Itoa(total))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), name) //已存在时失败，保证写入完整且只由第一个块写入
+	}
+	os.Remove(tmp.Name())
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if saved, _ := strconv.Atoi(string(b)); saved != total {
+		return fmt.Errorf("%w: %s=%d, expect %s", ErrChunkParam, chunkTotalParam, total, b)
+	}
+	return nil
+}
+
+//清理超过upload.chunk_lifetime未完成的分块，每chunk_lifetime/10秒最多执行一次，chunk_lifetime<=0时不清理
+func (this *Request) chunkGc() {
+	lifetime, _ := strconv.ParseInt(this.Conf["upload.chunk_lifetime"], 10, 64)
+	if lifetime <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&chunkGcTime)
+	if now-last < lifetime/10 || !atomic.CompareAndSwapInt64(&chunkGcTime, last, now) {
+		return
+	}
+	root := filepath.Join(this.Conf["upload.path"], "chunks")
+	go func() {
+		entries, _ := os.ReadDir(root)
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !e.IsDir() || now-info.ModTime().Unix() < lifetime {
+				continue
+			}
+			os.RemoveAll(filepath.Join(root, e.Name()))
+			this.Log.Write(LL_SYS, "chunk gc: id=%s", e.Name())
+		}
+	}()
+}
+
+//已收到的块，序号 => 大小
+func chunkList(dir string) map[int]int64 {
+	chunks := make(map[int]int64)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		i, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			chunks[i] = info.Size()
+		}
+	}
+	return chunks
+}
+
+//把文件内容追加到w
+func appendFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+//文件内容的md5
+func fileMd5(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
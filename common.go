@@ -4,10 +4,10 @@ package ecgo
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	. "github.com/tim1020/ecgo/dao"
 	. "github.com/tim1020/ecgo/util"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -17,11 +17,16 @@ import (
 )
 
 var (
-	RootPath   string   //应用根目录（执行文件所在目录)
-	RequestSep string   //Get/Post属性中，对同名参数内容使用的分隔符
-	confFile   []string //配置文件
-	viewPath   string   //模板路径
-	viewMTime  int64    //模板编译时间
+	RootPath string //应用根目录（执行文件所在目录)
+	Env      string //配置profile，取自启动参数-env或环境变量ECGO_ENV，如prod时在conf.ini之后载入conf.prod.ini
+	confPath string //配置目录，可用启动参数-conf指定
+	viewPath string //模板路径
+)
+
+//启动参数，注册在flag.CommandLine中，应用使用flag包时不需要另外定义
+var (
+	envFlag  = flag.String("env", "", "config profile, e.g. prod loads conf.prod.ini after conf.ini (default $ECGO_ENV)")
+	confFlag = flag.String("conf", "", "config dir (default <app dir>/conf)")
 )
 
 //包初始化
@@ -29,19 +34,68 @@ func init() {
 	//确定运行目录
 	file, _ := filepath.Abs(os.Args[0])
 	RootPath = filepath.Dir(file) //将执行文件所在的路径设为应用的根路径
-	//遍历获取所有配置文件
-	cPath := RootPath + "/conf/"
-	files, _ := ioutil.ReadDir(cPath)
-	for _, f := range files { //遍历模板目录,
-		if f.IsDir() {
+	//配置目录
+	confPath = RootPath + "/conf/"
+	//模板目录
+	viewPath = RootPath + "/views/"
+}
+
+//在New中确定配置目录和profile：启动参数-conf、-env，或环境变量ECGO_ENV
+func initEnv() {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if *confFlag != "" {
+		dir, _ := filepath.Abs(*confFlag)
+		confPath = dir + "/"
+	}
+	if Env = *envFlag; Env == "" {
+		Env = os.Getenv("ECGO_ENV")
+	}
+}
+
+//配置文件支持的扩展名
+var confExts = []string{".ini", ".yaml", ".yml", ".toml", ".json"}
+
+//要载入的配置文件，按顺序合并：conf.<ext>，conf目录下其它的配置文件(按文件名顺序，不含conf.*)，最后是当前profile的conf.<Env>.<ext>
+//
+//ext按confExts的顺序，同一目录中可同时使用多种格式
+func confFiles() (files []string) {
+	entries, _ := os.ReadDir(confPath) //按文件名排序
+	var others []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !isConfFile(name) || strings.HasPrefix(name, "conf.") {
 			continue
 		}
-		if filepath.Ext(f.Name()) == ".ini" {
-			confFile = append(confFile, cPath+f.Name())
+		others = append(others, confPath+name)
+	}
+	files = append(files, existFiles(confPath+"conf")...)
+	files = append(files, others...)
+	if Env != "" {
+		files = append(files, existFiles(confPath+"conf."+Env)...)
+	}
+	return
+}
+
+func isConfFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range confExts {
+		if ext == e {
+			return true
 		}
 	}
-	//模板目录
-	viewPath = RootPath + "/views/"
+	return false
+}
+
+//base加上各配置扩展名后存在的文件
+func existFiles(base string) (files []string) {
+	for _, ext := range confExts {
+		if _, err := os.Stat(base + ext); err == nil {
+			files = append(files, base+ext)
+		}
+	}
+	return
 }
 
 //处理错误
@@ -51,28 +105,23 @@ func checkError(err error) {
 	}
 }
 
-//检查conf
+//检查conf：替换环境变量，按内置和应用注册的规则设置缺省值并校验，再检查需要解析的配置项
 func checkConf(conf map[string]string) (err error) {
-	var num int
-	var errs []string
-	//default
-	setConfDefault(conf, "listen", ":8080")
-	setConfDefault(conf, "prefix_control", "PreControl")
-	setConfDefault(conf, "request_sep", "&")
-	setConfDefault(conf, "static_path", RootPath)
-	setConfDefault(conf, "static_prefix", "/public/")
-	setConfDefault(conf, "stats_page", "off")
-	setConfDefault(conf, "RESTful", "off")
-	setConfDefault(conf, "default_controll", "Index")
-	setConfDefault(conf, "stats_interval", "30")
-	if _, err := strconv.Atoi(conf["stats_interval"]); err != nil {
-		errs = append(errs, fmt.Sprintf("stats_interval: %s not a number", conf["stats_interval"]))
+	expandConfEnv(conf)
+	ruleLock.Lock()
+	rules := append(builtinConfRules(), confRules...)
+	ruleLock.Unlock()
+	errs := applyConfRules(conf, rules)
+	if _, mErrs := parseStaticMounts(conf); len(mErrs) > 0 {
+		errs = append(errs, mErrs...)
+	}
+	if _, cErrs := parseCompress(conf); len(cErrs) > 0 {
+		errs = append(errs, cErrs...)
+	}
+	if _, fErrs := parseFilter(conf); len(fErrs) > 0 {
+		errs = append(errs, fErrs...)
 	}
 	//log
-	setConfDefault(conf, "log.level", LL_ALL)
-	setConfDefault(conf, "log.path", RootPath+"/logs")
-	setConfDefault(conf, "log.access_log", "off")
-	setConfDefault(conf, "log.access_log_format", "method path code execute_time size")
 	//检查分隔符
 	seps := []string{" ", "`", ",", "|", "&"}
 	for _, sep := range seps {
@@ -83,65 +132,22 @@ func checkConf(conf map[string]string) (err error) {
 	}
 	setConfDefault(conf, "log.access_log_sep", " ")
 	//检查字段
-	af := "method,path,code,size,execute_time,ua,ip,referer"
+	af := "method,path,code,size,raw_size,execute_time,ua,ip,referer"
 	files := strings.Split(conf["log.access_log_format"], conf["log.access_log_sep"])
 	for _, f := range files {
 		if !strings.Contains(af, f) {
 			errs = append(errs, fmt.Sprintf("log.access_log_format: field=%s not support", f))
 		}
 	}
-	//session
-	setConfDefault(conf, "session.auto_start", "off")
-	setConfDefault(conf, "session.handler", "file")
-	if conf["session.handler"] != "file" && conf["session.handler"] != "memcache" {
-		errs = append(errs, fmt.Sprintf("session.handler: ivalid handler %s", conf["session.handler"]))
-	}
-	setConfDefault(conf, "session.path", os.TempDir()+"/sess")
-	setConfDefault(conf, "session.sid", "ECGO_SID")
-	setConfDefault(conf, "session.cookie_lifetime", "0")
-	if _, err := strconv.Atoi(conf["session.cookie_lifetime"]); err != nil {
-		errs = append(errs, fmt.Sprintf("session.cookie_lifetime: %s not a number", conf["session.cookie_lifetime"]))
-	}
-	setConfDefault(conf, "session.gc_divisor", "10")
-	num, err = strconv.Atoi(conf["session.gc_divisor"])
-	if err != nil {
-		errs = append(errs, fmt.Sprintf("session.gc_divisor: %s not a number", conf["session.gc_divisor"]))
-	} else if num < 1 || num > 100 {
-		errs = append(errs, "session.gc_divisor: expect 1-100")
-	}
-	setConfDefault(conf, "session.gc_lifetime", "36000")
-	if _, err := strconv.Atoi(conf["session.gc_lifetime"]); err != nil {
-		errs = append(errs, fmt.Sprintf("session.gc_lifetime: %s not a number", conf["session.gc_lifetime"]))
-	}
-	//db
-	setConfDefault(conf, "db.mc_server", "")
-	setConfDefault(conf, "db.mysql_dsn", "")
-	setConfDefault(conf, "db.max_open_conns", "100")
-	num, err = strconv.Atoi(conf["db.max_open_conns"])
-	if err != nil {
-		errs = append(errs, fmt.Sprintf("db.max_open_conns: %s not a number", conf["db.max_open_conns"]))
-	} else if num < 10 || num > 1000 {
-		errs = append(errs, "db.max_open_conns: expect 10-1000")
-	}
-	setConfDefault(conf, "db.max_idle_conns", "20")
-	num, err = strconv.Atoi(conf["db.max_idle_conns"])
-	if err != nil {
-		errs = append(errs, fmt.Sprintf("db.max_idle_conns: %s not a number", conf["db.max_idle_conns"]))
-	} else if num < 1 || num > 100 {
-		errs = append(errs, "db.max_idle_conns error: expect 1-100")
-	}
 	//upload
-	setConfDefault(conf, "upload.path", os.TempDir()+"/upload")
-	setConfDefault(conf, "upload.allow_mime", "")
-	size, _ := conf["upload.max_size"]
+	size := conf["upload.max_size"]
 	if size == "" {
 		size = "1M"
 	}
 	l := len(size)
 	unit := strings.ToUpper(size[l-1:])
-	val := size[0 : l-1]
-	num, err = strconv.Atoi(val)
-	if err != nil || num < 1 || num > 1000 || (unit != "M" && unit != "K") {
+	num, e := strconv.Atoi(size[0 : l-1])
+	if e != nil || num < 1 || num > 1000 || (unit != "M" && unit != "K") {
 		errs = append(errs, "upload.max_size: expect 1-1000(K or M)")
 	}
 	if unit == "M" {
@@ -149,6 +155,17 @@ func checkConf(conf map[string]string) (err error) {
 	} else if unit == "K" {
 		conf["upload.max_size"] = strconv.Itoa(num * 1024)
 	}
+	if _, err := newUploadStorage(conf); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, k := range []string{"upload.chunk_max_size", "upload.max_body", "log.max_size"} {
+		if n, err := parseSize(conf[k]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", k, err.Error()))
+		} else {
+			conf[k] = strconv.FormatInt(n, 10)
+		}
+	}
+	errs = append(errs, checkImageRules(conf)...)
 	//处理错误
 	if len(errs) > 0 {
 		err = errors.New(strings.Join(errs, "; "))
@@ -156,6 +173,28 @@ func checkConf(conf map[string]string) (err error) {
 	return
 }
 
+//解析大小，可带单位K/M/G，如 10M，0表示不限制
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s not a size, expect number with K/M/G", s)
+	}
+	return n * unit, nil
+}
+
 //如果conf中不存在key，则把key设置为val
 func setConfDefault(conf map[string]string, key string, val string) {
 	if _, exists := conf[key]; !exists {
@@ -194,18 +233,59 @@ func (this *Request) NewMcDao() *Mc {
 	return this.mcDao
 }
 
+//共用的mysql连接池，refs为正在使用的请求数，dsn改变后旧的连接池在没有请求使用时关闭
+type sharedDB struct {
+	*MySQL
+	dsn     string
+	refs    int
+	retired bool
+}
+
+//取得共用的mysql连接池并增加引用，dsn改变时重新创建，使用完后须调用releaseMySQL
+func (this *Application) acquireMySQL(conf Config) (*sharedDB, error) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+	dsn := conf["db.mysql_dsn"]
+	if this.mysql == nil || this.mysql.dsn != dsn {
+		oc, ic := conf.Int("db.max_open_conns", 100), conf.Int("db.max_idle_conns", 20)
+		this.Log.Write(LL_SYS, "new mysql pool,dsn=%s,openConn=%d,idleConn=%d", dsn, oc, ic)
+		mysql, err := NewMySQL(dsn, "", oc, ic)
+		if err != nil {
+			return nil, err
+		}
+		if old := this.mysql; old != nil {
+			old.retired = true
+			if old.refs == 0 {
+				old.Close()
+			}
+		}
+		this.mysql = &sharedDB{MySQL: mysql, dsn: dsn}
+	}
+	this.mysql.refs++
+	return this.mysql, nil
+}
+
+//释放连接池的引用，已被替换的连接池在最后一个引用释放时关闭
+func (this *Application) releaseMySQL(db *sharedDB) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+	if db.refs--; db.refs == 0 && db.retired {
+		this.Log.Write(LL_SYS, "close retired mysql pool,dsn=%s", db.dsn)
+		db.Close()
+	}
+}
+
 //生成mysql操作对象
 func (this *Request) NewMySQLDao(table string) (*MySQL, error) {
 	this.Log.Write(LL_SYS, "[%s]get MySQL dao", this.appId)
 	if this.mysqlDao == nil {
-		oc, _ := strconv.Atoi(this.Conf["db.max_open_conns"])
-		ic, _ := strconv.Atoi(this.Conf["db.max_idle_conns"])
-		this.Log.Write(LL_SYS, "[%s]new mysql,dsn=%s,table=%s,openConn=%d,idleConn=%d", this.appId, this.Conf["db.mysql_dsn"], table, oc, ic)
-		mysql, err := NewMySQL(this.Conf["db.mysql_dsn"], table, oc, ic)
+		pool, err := this.acquireMySQL(this.Conf)
 		if err != nil {
 			return nil, err
 		}
-		this.mysqlDao = mysql
+		this.Log.Write(LL_SYS, "[%s]new mysql,dsn=%s,table=%s", this.appId, this.Conf["db.mysql_dsn"], table)
+		this.mysqlRef = pool
+		this.mysqlDao = NewMySQLWithDB(pool.DB, table)
 	} else {
 		this.Log.Write(LL_SYS, "[%s]MySQL dao already exists", this.appId)
 	}
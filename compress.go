@@ -0,0 +1,161 @@
+//响应压缩：根椐Accept-Encoding使用br或gzip压缩输出，在[compress]中配置
+//
+//	enable=on                             是否开启
+//	min_size=1024                         小于此字节数的响应不压缩
+//	types=text/*,application/json         需要压缩的Content-Type(多个用逗号分隔，可用text/*)
+//	level=6                               压缩级别1-9
+//
+//已设置Content-Encoding(如预压缩的静态文件)，或状态码为204/206/304的响应不压缩
+
+package ecgo
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//压缩配置
+type compressConf struct {
+	minSize int
+	types   string
+	level   int
+}
+
+//解析[compress]配置，未开启时返回nil
+func parseCompress(conf map[string]string) (c *compressConf, errs []string) {
+	c = &compressConf{types: conf["compress.types"]}
+	var err error
+	if c.minSize, err = strconv.Atoi(conf["compress.min_size"]); err != nil || c.minSize < 0 {
+		errs = append(errs, fmt.Sprintf("compress.min_size: %s not a number", conf["compress.min_size"]))
+	}
+	if c.level, err = strconv.Atoi(conf["compress.level"]); err != nil || c.level < 1 || c.level > 9 {
+		errs = append(errs, "compress.level: expect 1-9")
+	}
+	if conf["compress.enable"] != "on" {
+		return nil, errs
+	}
+	return
+}
+
+//压缩输出，位于resWriter与http.ResponseWriter之间
+//
+//先缓存min_size字节的内容，再决定是否压缩，此前不输出header
+type compressWriter struct {
+	http.ResponseWriter
+	conf    *compressConf
+	accept  string //请求的Accept-Encoding
+	code    int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser //nil时不压缩
+	written int            //实际输出的字节数
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request, c *compressConf) *compressWriter {
+	return &compressWriter{ResponseWriter: w, conf: c, accept: r.Header.Get("Accept-Encoding"), code: http.StatusOK}
+}
+
+func (this *compressWriter) WriteHeader(code int) {
+	if this.decided {
+		return
+	}
+	this.code = code
+	switch code {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		this.decide(false)
+	}
+}
+
+func (this *compressWriter) Write(b []byte) (int, error) {
+	if !this.decided {
+		this.buf = append(this.buf, b...)
+		if len(this.buf) >= this.conf.minSize {
+			if err := this.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if this.enc != nil {
+		return this.enc.Write(b)
+	}
+	n, err := this.ResponseWriter.Write(b)
+	this.written += n
+	return n, err
+}
+
+//输出header及缓存的内容，compress为true且满足条件时开始压缩
+func (this *compressWriter) decide(compress bool) error {
+	this.decided = true
+	header := this.Header()
+	if header.Get("Content-Type") == "" && len(this.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(this.buf))
+	}
+	var encoding string
+	if compress && header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		mimeAllowed(header.Get("Content-Type"), this.conf.types) {
+		for _, enc := range []string{"br", "gzip"} {
+			if acceptEncoding(this.accept, enc) {
+				encoding = enc
+				break
+			}
+		}
+	}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+		header.Del("Content-Length")
+		header.Add("Vary", "Accept-Encoding")
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) { //内容已改变，强ETag改为弱ETag
+			header.Set("ETag", "W/"+etag)
+		}
+		cw := &countWriter{w: this.ResponseWriter, n: &this.written}
+		if encoding == "br" {
+			this.enc = brotli.NewWriterLevel(cw, this.conf.level)
+		} else {
+			this.enc, _ = gzip.NewWriterLevel(cw, this.conf.level)
+		}
+	}
+	this.ResponseWriter.WriteHeader(this.code)
+	buf := this.buf
+	this.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if this.enc != nil {
+		_, err = this.enc.Write(buf)
+	} else {
+		var n int
+		n, err = this.ResponseWriter.Write(buf)
+		this.written += n
+	}
+	return err
+}
+
+//请求结束时调用：输出未达min_size的内容，结束压缩
+func (this *compressWriter) Close() error {
+	if !this.decided {
+		this.decide(false)
+	}
+	if this.enc != nil {
+		return this.enc.Close()
+	}
+	return nil
+}
+
+//统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n *int
+}
+
+func (this *countWriter) Write(b []byte) (n int, err error) {
+	n, err = this.w.Write(b)
+	*this.n += n
+	return
+}
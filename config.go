@@ -0,0 +1,526 @@
+//配置的类型化读取、环境变量处理，以及声明式的配置规则(缺省值和校验)
+//
+//配置值中的${NAME}会替换为环境变量NAME的值，可用${NAME:-default}指定未设置时的值；
+//环境变量ECGO_<KEY>会覆盖同名配置，KEY为配置名转大写且.替换为_，如 ECGO_DB_MYSQL_DSN 覆盖 db.mysql_dsn；
+//配置文件中没有的项也可以这样设置(如密钥)，第一个_为section分隔，如 ECGO_UPLOAD_S3_SECRET_KEY 设置 upload.s3_secret_key
+//
+//应用可在New之前注册自己的配置项：
+//
+//	ecgo.RegisterConf(
+//		ecgo.ConfRule{Key: "app.page_size", Default: "20", Type: ecgo.CONF_INT, Min: 1, Max: 100},
+//		ecgo.ConfRule{Key: "app.mode", Default: "dev", Enum: []string{"dev", "prod"}},
+//	)
+//	...
+//	size := this.ConfInt("app.page_size", 20)
+//
+//在Controller中this.Conf和this.ConfInt等读取的是请求开始时的配置快照，请求处理中的重载不会影响；
+//在Application上调用时读取的是当前配置
+
+package ecgo
+
+import (
+	"fmt"
+	. "github.com/tim1020/ecgo/util"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//配置值类型
+const (
+	CONF_STRING   = iota
+	CONF_INT      //整数
+	CONF_BOOL     //on/off, true/false, 1/0, yes/no
+	CONF_DURATION //时长，如 30s, 5m，纯数字为秒数
+	CONF_LIST     //逗号分隔的列表
+)
+
+//配置规则
+type ConfRule struct {
+	Key     string
+	Default string
+	Type    int
+	Min     int64                  //CONF_INT的最小值，Min和Max都为0时不检查范围
+	Max     int64                  //CONF_INT的最大值
+	Enum    []string               //可选值，为空时不检查
+	Check   func(val string) error //自定义校验
+}
+
+var (
+	confRules []ConfRule //应用注册的配置规则
+	ruleLock  sync.Mutex
+)
+
+var reConfEnv = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+//注册配置规则，在New之前调用，启动及重载配置时按规则设置缺省值并校验
+func RegisterConf(rules ...ConfRule) {
+	ruleLock.Lock()
+	confRules = append(confRules, rules...)
+	ruleLock.Unlock()
+}
+
+//内置的配置规则，compress/filter/upload.storage等由对应的parse函数校验
+func builtinConfRules() []ConfRule {
+	return []ConfRule{
+		{Key: "listen", Default: ":8080"},
+		{Key: "prefix_control", Default: "PreControl"},
+		{Key: "request_sep", Default: "&"},
+		{Key: "static_path", Default: RootPath},
+		{Key: "static_prefix", Default: "/public/"},
+		{Key: "static_cache", Check: checkCachePolicy},
+		{Key: "static_allow_mime", Default: "all"},
+		{Key: "static_precompress", Default: "on", Type: CONF_BOOL},
+		{Key: "static_list_dir", Default: "off", Type: CONF_BOOL},
+		{Key: "stats_page", Default: "off", Type: CONF_BOOL},
+		{Key: "RESTful", Default: "off", Type: CONF_BOOL},
+		{Key: "default_controll", Default: "Index"},
+		{Key: "stats_interval", Default: "30", Type: CONF_INT},
+		{Key: "compress.enable", Default: "off", Type: CONF_BOOL},
+		{Key: "compress.min_size", Default: "1024"},
+		{Key: "compress.types", Default: "text/*,application/javascript,application/json,application/xml,image/svg+xml", Type: CONF_LIST},
+		{Key: "compress.level", Default: "6"},
+		{Key: "filter.mode", Default: "none"},
+		{Key: "filter.trim", Default: "off", Type: CONF_BOOL},
+		{Key: "filter.normalize"},
+		{Key: "filter.rich_fields", Type: CONF_LIST},
+		{Key: "filter.allow_tags", Default: defaultAllowTags, Type: CONF_LIST},
+		{Key: "filter.actions"},
+		{Key: "auto_reload", Default: "on", Type: CONF_BOOL},
+		{Key: "auto_reload_delay", Default: "300", Type: CONF_INT},
+		{Key: "log.level", Default: LL_ALL},
+		{Key: "log.path", Default: RootPath + "/logs"},
+		{Key: "log.format", Default: LOG_TEXT, Enum: []string{LOG_TEXT, LOG_JSON, LOG_LOGFMT}},
+		{Key: "log.output", Default: "file", Check: CheckLogOutput},
+		{Key: "log.rotate", Default: ROTATE_DAILY, Enum: []string{ROTATE_DAILY, ROTATE_HOURLY, ROTATE_NONE}},
+		{Key: "log.max_size", Default: "0"},
+		{Key: "log.max_backups", Default: "0", Type: CONF_INT},
+		{Key: "log.max_days", Default: "0", Type: CONF_INT},
+		{Key: "log.compress", Default: "off", Type: CONF_BOOL},
+		{Key: "log.access_log", Default: "off", Type: CONF_BOOL},
+		{Key: "log.access_log_format", Default: "method path code execute_time size"},
+		{Key: "session.auto_start", Default: "off", Type: CONF_BOOL},
+		{Key: "session.handler", Default: "file", Enum: []string{"file", "memcache"}},
+		{Key: "session.path", Default: os.TempDir() + "/sess"},
+		{Key: "session.sid", Default: "ECGO_SID"},
+		{Key: "session.cookie_lifetime", Default: "0", Type: CONF_INT},
+		{Key: "session.gc_divisor", Default: "10", Type: CONF_INT, Min: 1, Max: 100},
+		{Key: "session.gc_lifetime", Default: "36000", Type: CONF_INT},
+		{Key: "db.mc_server"},
+		{Key: "db.mysql_dsn"},
+		{Key: "db.max_open_conns", Default: "100", Type: CONF_INT, Min: 10, Max: 1000},
+		{Key: "db.max_idle_conns", Default: "20", Type: CONF_INT, Min: 1, Max: 100},
+		{Key: "upload.path", Default: os.TempDir() + "/upload"},
+		{Key: "upload.allow_mime", Default: "all"},
+		{Key: "upload.check_ext", Default: "on", Type: CONF_BOOL},
+		{Key: "upload.file_perm", Default: "0644", Check: checkPerm},
+		{Key: "upload.dir_perm", Default: "0755", Check: checkPerm},
+		{Key: "upload.storage", Default: "temp"},
+		{Key: "upload.s3_region", Default: "us-east-1"},
+		{Key: "upload.max_size", Default: "1M"},
+		{Key: "upload.max_body", Default: "32M"},
+		{Key: "upload.chunk_max_size", Default: "2G"},
+		{Key: "upload.chunk_lifetime", Default: "86400", Type: CONF_INT},
+	}
+}
+
+//按规则设置缺省值并校验，返回错误信息
+func applyConfRules(conf map[string]string, rules []ConfRule) (errs []string) {
+	for _, r := range rules {
+		setConfDefault(conf, r.Key, r.Default)
+	}
+	overrideConfEnv(conf, rules)
+	for _, r := range rules {
+		if err := r.check(conf[r.Key]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Key, err.Error()))
+		} else if r.Type == CONF_BOOL { //统一为on/off
+			if b, _ := parseConfBool(conf[r.Key]); b {
+				conf[r.Key] = "on"
+			} else {
+				conf[r.Key] = "off"
+			}
+		}
+	}
+	return
+}
+
+//按规则检查一个值
+func (this *ConfRule) check(val string) error {
+	switch this.Type {
+	case CONF_INT:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s not a number", val)
+		}
+		if (this.Min != 0 || this.Max != 0) && (n < this.Min || n > this.Max) {
+			return fmt.Errorf("expect %d-%d", this.Min, this.Max)
+		}
+	case CONF_BOOL:
+		if _, ok := parseConfBool(val); !ok {
+			return fmt.Errorf("%s not a bool, expect on/off", val)
+		}
+	case CONF_DURATION:
+		if _, ok := parseConfDuration(val); !ok {
+			return fmt.Errorf("%s not a duration", val)
+		}
+	}
+	if len(this.Enum) > 0 {
+		found := false
+		for _, e := range this.Enum {
+			if val == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid value %s, expect %s", val, strings.Join(this.Enum, "|"))
+		}
+	}
+	if this.Check != nil {
+		return this.Check(val)
+	}
+	return nil
+}
+
+//替换配置值中的${NAME}和${NAME:-default}
+func expandConfEnv(conf map[string]string) {
+	for k, v := range conf {
+		if !strings.Contains(v, "${") {
+			continue
+		}
+		conf[k] = reConfEnv.ReplaceAllStringFunc(v, func(s string) string {
+			m := reConfEnv.FindStringSubmatch(s)
+			if val, exists := os.LookupEnv(m[1]); exists && (val != "" || m[2] == "") {
+				return val
+			}
+			return m[3]
+		})
+	}
+}
+
+//没有缺省值(不在规则中)的顶层配置项，可用环境变量设置
+var confEnvKeys = []string{"listen", "RESTful", "default_controll", "prefix_control", "request_sep", "stats_page",
+	"static_path", "static_prefix", "static_cache", "static_allow_mime", "static_list_dir", "static_precompress"}
+
+//用ECGO_<KEY>环境变量覆盖配置：先按已有的配置、规则和confEnvKeys中的配置名匹配，
+//不匹配的用__分隔各级section，如 ECGO_STATIC__UPLOADS__PREFIX 设置 static.uploads.prefix，
+//否则按已有的最长section前缀匹配，都不匹配时第一个_为section分隔，如 ECGO_UPLOAD_S3_SECRET_KEY 设置 upload.s3_secret_key
+func overrideConfEnv(conf map[string]string, rules []ConfRule) {
+	names := make(map[string]string)    //环境变量名 => 配置名
+	sections := make(map[string]string) //section的环境变量名前缀 => section
+	addName := func(k string) {
+		names[confEnvName(k)] = k
+		if i := strings.LastIndex(k, "."); i > 0 {
+			sections[confEnvName(k[:i])+"_"] = k[:i]
+		}
+	}
+	for _, k := range confEnvKeys {
+		addName(k)
+	}
+	for _, r := range rules {
+		addName(r.Key)
+	}
+	for k := range conf {
+		addName(k)
+	}
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		if i < 0 || !strings.HasPrefix(env[:i], "ECGO_") || env[:i] == "ECGO_" || env[:i] == "ECGO_ENV" {
+			continue
+		}
+		k, exists := names[env[:i]]
+		if !exists {
+			k = confEnvKey(env[:i], sections)
+		}
+		conf[k] = env[i+1:]
+	}
+}
+
+//不匹配已有配置名的环境变量对应的配置名
+func confEnvKey(name string, sections map[string]string) string {
+	if strings.Contains(name[5:], "__") {
+		return strings.ToLower(strings.Replace(name[5:], "__", ".", -1))
+	}
+	section := ""
+	for prefix, s := range sections {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) && len(s) > len(section) {
+			section = s
+		}
+	}
+	if section != "" {
+		return section + "." + strings.ToLower(name[len(confEnvName(section))+1:])
+	}
+	return strings.Replace(strings.ToLower(name[5:]), "_", ".", 1)
+}
+
+//配置名对应的环境变量名：db.mysql_dsn => ECGO_DB_MYSQL_DSN
+func confEnvName(key string) string {
+	return "ECGO_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(key))
+}
+
+func checkPerm(val string) error {
+	_, err := parsePerm(val)
+	return err
+}
+
+func parseConfBool(val string) (b bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "on", "true", "1", "yes":
+		return true, true
+	case "off", "false", "0", "no", "":
+		return false, true
+	}
+	return false, false
+}
+
+//时长，纯数字为秒数
+func parseConfDuration(val string) (time.Duration, bool) {
+	val = strings.TrimSpace(val)
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, true
+	}
+	d, err := time.ParseDuration(val)
+	return d, err == nil
+}
+
+//配置内容，key为section.key
+type Config map[string]string
+
+//Int 整数值，key不存在或格式错误时返回def
+func (this Config) Int(key string, def int) int {
+	if n, err := strconv.Atoi(strings.TrimSpace(this[key])); err == nil {
+		return n
+	}
+	return def
+}
+
+//Int64 同Int，返回int64
+func (this Config) Int64(key string, def int64) int64 {
+	if n, err := strconv.ParseInt(strings.TrimSpace(this[key]), 10, 64); err == nil {
+		return n
+	}
+	return def
+}
+
+//Bool 可识别on/off, true/false, 1/0, yes/no，key不存在或格式错误时返回def
+func (this Config) Bool(key string, def bool) bool {
+	val, exists := this[key]
+	if !exists {
+		return def
+	}
+	if b, ok := parseConfBool(val); ok {
+		return b
+	}
+	return def
+}
+
+//Duration 如 30s, 5m, 1h30m，纯数字为秒数
+func (this Config) Duration(key string, def time.Duration) time.Duration {
+	if d, ok := parseConfDuration(this[key]); ok && this[key] != "" {
+		return d
+	}
+	return def
+}
+
+//List 逗号分隔的列表(去掉空白和空项)
+func (this Config) List(key string) []string {
+	var list []string
+	for _, s := range strings.Split(this[key], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+//Section 指定section下的配置，key中不含section前缀，如 Section("db")["mysql_dsn"]
+func (this Config) Section(name string) Config {
+	prefix := strings.ToLower(name) + "."
+	sec := make(Config)
+	for k, v := range this {
+		if strings.HasPrefix(k, prefix) {
+			sec[k[len(prefix):]] = v
+		}
+	}
+	return sec
+}
+
+//当前的配置(重载时整体替换，取得后不会再变化)
+func (this *Application) config() Config {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.Conf
+}
+
+//读取当前配置的整数值，不存在或无效时返回def
+func (this *Application) ConfInt(key string, def int) int {
+	return this.config().Int(key, def)
+}
+
+//读取当前配置的布尔值(on/off)
+func (this *Application) ConfBool(key string, def bool) bool {
+	return this.config().Bool(key, def)
+}
+
+//读取当前配置的时间长度
+func (this *Application) ConfDuration(key string, def time.Duration) time.Duration {
+	return this.config().Duration(key, def)
+}
+
+//读取当前配置的逗号分隔列表
+func (this *Application) ConfList(key string) []string {
+	return this.config().List(key)
+}
+
+//读取当前配置的一个section
+func (this *Application) ConfSection(name string) Config {
+	return this.config().Section(name)
+}
+
+//请求中读取配置的快照(this.Conf)，同一请求内的多次读取不受重载影响
+func (this *Request) ConfInt(key string, def int) int {
+	return this.Conf.Int(key, def)
+}
+
+//读取请求快照中的布尔值
+func (this *Request) ConfBool(key string, def bool) bool {
+	return this.Conf.Bool(key, def)
+}
+
+//读取请求快照中的时间长度
+func (this *Request) ConfDuration(key string, def time.Duration) time.Duration {
+	return this.Conf.Duration(key, def)
+}
+
+//读取请求快照中的列表
+func (this *Request) ConfList(key string) []string {
+	return this.Conf.List(key)
+}
+
+//读取请求快照中的一个section
+func (this *Request) ConfSection(name string) Config {
+	return this.Conf.Section(name)
+}
+
+//配置变化的订阅
+type confSubscriber struct {
+	keys []string
+	fn   func(old, new Config)
+}
+
+//订阅配置变化：重载配置后，keys中任一项的值有变化时调用fn(old为变化前的配置，new为新配置)
+//
+//key可以是完整的配置名，或 section.* 表示该section下的全部配置，keys为空时任何变化都调用；fn在监控协程中依次执行
+//
+//	app.OnConfChange([]string{"app.page_size"}, func(old, new ecgo.Config) {
+//		pageSize = new.Int("app.page_size", 20)
+//	})
+func (this *Application) OnConfChange(keys []string, fn func(old, new Config)) {
+	this.lock.Lock()
+	this.subscribers = append(this.subscribers, confSubscriber{keys: keys, fn: fn})
+	this.lock.Unlock()
+}
+
+//通知订阅者
+func (this *Application) notifyConfChange(old, new Config) {
+	this.lock.RLock()
+	subscribers := this.subscribers
+	this.lock.RUnlock()
+	for _, s := range subscribers {
+		if !confChanged(old, new, s.keys) {
+			continue
+		}
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					this.Log.E("conf change callback panic: keys=%v, %v", s.keys, err)
+				}
+			}()
+			s.fn(old, new)
+		}()
+	}
+}
+
+//keys对应的配置是否有变化
+func confChanged(old, new Config, keys []string) bool {
+	match := func(k string) bool {
+		if len(keys) == 0 {
+			return true
+		}
+		for _, key := range keys {
+			if k == key || (strings.HasSuffix(key, ".*") && strings.HasPrefix(k, key[:len(key)-1])) {
+				return true
+			}
+		}
+		return false
+	}
+	for k, v := range new {
+		if ov, exists := old[k]; (!exists || ov != v) && match(k) {
+			return true
+		}
+	}
+	for k := range old {
+		if _, exists := new[k]; !exists && match(k) {
+			return true
+		}
+	}
+	return false
+}
+
+//日志文件的切分和保留
+func logRotate(conf Config) LogRotate {
+	return LogRotate{
+		Period:     conf["log.rotate"],
+		MaxSize:    conf.Int64("log.max_size", 0),
+		MaxBackups: conf.Int("log.max_backups", 0),
+		MaxAge:     time.Duration(conf.Int("log.max_days", 0)) * 24 * time.Hour,
+		Compress:   conf.Bool("log.compress", false),
+	}
+}
+
+//内置的订阅：日志设置、数据库连接池、session处理器立即生效，listen的变化需要重启
+func (this *Application) confSubscribe() {
+	this.OnConfChange([]string{"log.*"}, func(old, new Config) {
+		this.Log.SetLevel(new["log.level"])
+		this.Log.SetPath(new["log.path"])
+		this.Log.SetFormat(new["log.format"])
+		this.Log.SetRotate(logRotate(new))
+		if old["log.output"] != new["log.output"] {
+			if err := this.Log.SetOutput(new["log.output"]); err != nil {
+				this.Log.E("log output apply fail: %s", err.Error())
+			}
+		}
+		this.Log.Write(LL_SYS, "log conf applied: level=%s, path=%s, format=%s, output=%s", new["log.level"], new["log.path"], new["log.format"], new["log.output"])
+	})
+	this.OnConfChange([]string{"db.max_open_conns", "db.max_idle_conns"}, func(old, new Config) {
+		this.dbLock.Lock()
+		defer this.dbLock.Unlock()
+		if this.mysql != nil { //dsn变化时由acquireMySQL重新创建
+			oc, ic := new.Int("db.max_open_conns", 100), new.Int("db.max_idle_conns", 20)
+			this.mysql.SetPool(oc, ic)
+			this.Log.Write(LL_SYS, "mysql pool applied: openConn=%d, idleConn=%d", oc, ic)
+		}
+	})
+	this.OnConfChange([]string{"session.handler"}, func(old, new Config) {
+		if this.userSess {
+			return
+		}
+		if s := newSessionHandler(new["session.handler"], this.Log); s != nil {
+			this.lock.Lock()
+			this.sessHandler = s
+			this.lock.Unlock()
+			this.Log.Write(LL_SYS, "session handler applied: %s", new["session.handler"])
+		}
+	})
+	this.OnConfChange([]string{"listen"}, func(old, new Config) {
+		this.Log.W("listen changed from %s to %s, restart needed", old["listen"], new["listen"])
+	})
+}
@@ -26,6 +26,7 @@ type MySQL struct {
 	field        string //查询的字段
 	err          error
 	tx           *sql.Tx
+	shared       bool //使用共用的连接池，Close时不关闭
 }
 
 //生成mysql操作对象
@@ -33,12 +34,25 @@ func NewMySQL(dsn string, table string, openConn int, idleConn int) (mysql *MySQ
 	db, err := sql.Open("mysql", dsn)
 	if err == nil {
 		db.Ping()
-		mysql = &MySQL{DB: db, Table: table, maxOpenConns: openConn, maxIdleConns: idleConn, field: "*"}
+		mysql = &MySQL{DB: db, Table: table, field: "*"}
+		mysql.SetPool(openConn, idleConn)
 	}
 
 	return
 }
 
+//使用已有的连接池生成mysql操作对象，多个对象共用连接池，Close时不关闭连接池
+func NewMySQLWithDB(db *sql.DB, table string) *MySQL {
+	return &MySQL{DB: db, Table: table, field: "*", shared: true}
+}
+
+//设置连接池的最大连接数和最大空闲连接数，可在使用中修改
+func (this *MySQL) SetPool(openConn int, idleConn int) {
+	this.maxOpenConns, this.maxIdleConns = openConn, idleConn
+	this.DB.SetMaxOpenConns(openConn)
+	this.DB.SetMaxIdleConns(idleConn)
+}
+
 //指定表名
 func (this *MySQL) SetTable(table string) *MySQL {
 	this.Table = table
@@ -237,7 +251,7 @@ func (this *MySQL) LastError() error {
 
 //释放连接
 func (this *MySQL) Close() {
-	if this.DB != nil {
+	if this.DB != nil && !this.shared {
 		this.DB.Close()
 	}
 }
@@ -0,0 +1,268 @@
+//输入过滤：对Get/Post参数做html转义或去掉标签，富文本字段使用白名单过滤，以及去空白和Unicode规范化
+//
+//	[filter]
+//	mode=escape                     none(缺省)|escape(html转义)|strip(去掉标签，文本做html转义)
+//	trim=on                         去掉首尾空白
+//	normalize=NFC                   Unicode规范化NFC|NFKC，并去掉控制字符(保留\t\r\n)
+//	rich_fields=content,intro       富文本字段，按allow_tags白名单过滤，不做escape/strip
+//	allow_tags=p,br,b,i,a,img       富文本允许的标签，缺省为常用的排版标签
+//	actions=ArticleSave:none Search:strip   按action指定mode，多个用空格分隔
+//
+//过滤作用于Get/Post及GetAll/GetParams等方法，原始值可从this.Req中读取(如this.Req.URL.Query(), this.Req.PostForm)
+
+package ecgo
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+//富文本缺省允许的标签
+const defaultAllowTags = "p,br,hr,b,i,u,s,strong,em,sub,sup,small,blockquote,code,pre,h1,h2,h3,h4,h5,h6,ul,ol,li,a,img,span,div,table,thead,tbody,tr,th,td"
+
+//允许的属性，其它属性(包括style和on*事件)一律去掉
+var allowAttrs = map[string][]string{
+	"a":   {"href", "title", "target"},
+	"img": {"src", "alt", "title", "width", "height"},
+	"td":  {"colspan", "rowspan"},
+	"th":  {"colspan", "rowspan"},
+}
+
+//内容也一并去掉的标签
+var dropContentTags = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "embed": true, "noscript": true, "template": true, "textarea": true, "title": true}
+
+//过滤配置
+type filterConf struct {
+	mode      string
+	trim      bool
+	normalize string
+	rich      map[string]bool
+	allowTags map[string]bool
+	actions   map[string]string
+}
+
+//解析[filter]配置，没有需要做的过滤时返回nil
+func parseFilter(conf map[string]string) (f *filterConf, errs []string) {
+	f = &filterConf{
+		mode:      conf["filter.mode"],
+		trim:      conf["filter.trim"] == "on",
+		normalize: strings.ToUpper(conf["filter.normalize"]),
+		rich:      make(map[string]bool),
+		allowTags: make(map[string]bool),
+		actions:   make(map[string]string),
+	}
+	checkMode := func(key, mode string) {
+		if mode != "none" && mode != "escape" && mode != "strip" {
+			errs = append(errs, fmt.Sprintf("%s: invalid mode %s, expect none|escape|strip", key, mode))
+		}
+	}
+	checkMode("filter.mode", f.mode)
+	if f.normalize != "" && f.normalize != "NFC" && f.normalize != "NFKC" {
+		errs = append(errs, fmt.Sprintf("filter.normalize: expect NFC or NFKC, got %s", f.normalize))
+	}
+	for _, s := range strings.Split(conf["filter.rich_fields"], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			f.rich[s] = true
+		}
+	}
+	for _, s := range strings.Split(conf["filter.allow_tags"], ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			f.allowTags[s] = true
+		}
+	}
+	for _, s := range strings.Fields(conf["filter.actions"]) {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 {
+			errs = append(errs, fmt.Sprintf("filter.actions: expect Action:mode, got %s", s))
+			continue
+		}
+		checkMode("filter.actions", kv[1])
+		f.actions[kv[0]] = kv[1]
+	}
+	if f.mode == "none" && !f.trim && f.normalize == "" && len(f.rich) == 0 && len(f.actions) == 0 {
+		return nil, errs
+	}
+	return
+}
+
+//按action过滤一组参数，返回新的url.Values(不修改原始值)
+func (this *filterConf) filterValues(action string, vals url.Values) url.Values {
+	mode := this.mode
+	if m, exists := this.actions[action]; exists {
+		mode = m
+	}
+	out := make(url.Values, len(vals))
+	for k, v := range vals {
+		rich := this.rich[strings.TrimSuffix(k, "[]")]
+		nv := make([]string, len(v))
+		for i, s := range v {
+			nv[i] = this.filter(s, mode, rich)
+		}
+		out[k] = nv
+	}
+	return out
+}
+
+func (this *filterConf) filter(s, mode string, rich bool) string {
+	if this.normalize != "" {
+		s = normalizeString(s, this.normalize)
+	}
+	if this.trim {
+		s = strings.TrimSpace(s)
+	}
+	switch {
+	case rich:
+		s = sanitizeHTML(s, this.allowTags)
+	case mode == "escape":
+		s = html.EscapeString(s)
+	case mode == "strip":
+		s = stripTags(s)
+	}
+	return s
+}
+
+//Unicode规范化，并去掉控制字符(保留\t\r\n)
+func normalizeString(s, form string) string {
+	if form == "NFKC" {
+		s = norm.NFKC.String(s)
+	} else {
+		s = norm.NFC.String(s)
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\r' && r != '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+//去掉全部标签，只保留文本(文本按html转义)，script/style等标签的内容也去掉
+func stripTags(s string) string {
+	if !strings.ContainsAny(s, "<&") {
+		return html.EscapeString(s)
+	}
+	var buf bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := ""
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return buf.String()
+		}
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken:
+			if skip == "" && dropContentTags[tok.Data] {
+				skip = tok.Data
+			}
+		case html.EndTagToken:
+			if tok.Data == skip {
+				skip = ""
+			}
+		case html.TextToken:
+			if skip == "" {
+				buf.WriteString(html.EscapeString(tok.Data)) //Data已解码实体，需重新转义，否则&lt;img&gt;会变成标签
+			}
+		}
+	}
+}
+
+//按白名单过滤html：只保留允许的标签和属性，链接只允许http(s)/mailto/相对地址，未闭合的标签自动闭合
+func sanitizeHTML(s string, allowTags map[string]bool) string {
+	var buf bytes.Buffer
+	var stack []string
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := ""
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		if skip != "" {
+			if tt == html.EndTagToken && tok.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if dropContentTags[tok.Data] && tt == html.StartTagToken {
+				skip = tok.Data
+				continue
+			}
+			if !allowTags[tok.Data] {
+				continue
+			}
+			buf.WriteString("<" + tok.Data)
+			for _, a := range tok.Attr {
+				if !attrAllowed(tok.Data, a) {
+					continue
+				}
+				buf.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+			}
+			if voidTag(tok.Data) {
+				buf.WriteString(" />")
+			} else if tt == html.SelfClosingTagToken {
+				buf.WriteString("></" + tok.Data + ">")
+			} else {
+				buf.WriteString(">")
+				stack = append(stack, tok.Data)
+			}
+		case html.EndTagToken:
+			for i := len(stack) - 1; i >= 0; i-- { //闭合到对应的开始标签，没有时忽略
+				if stack[i] == tok.Data {
+					for j := len(stack) - 1; j >= i; j-- {
+						buf.WriteString("</" + stack[j] + ">")
+					}
+					stack = stack[:i]
+					break
+				}
+			}
+		case html.TextToken:
+			buf.WriteString(html.EscapeString(tok.Data))
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		buf.WriteString("</" + stack[i] + ">")
+	}
+	return buf.String()
+}
+
+func voidTag(tag string) bool {
+	return tag == "br" || tag == "hr" || tag == "img"
+}
+
+//属性是否允许，链接地址须为http(s)/mailto或相对地址
+func attrAllowed(tag string, a html.Attribute) bool {
+	allowed := false
+	for _, k := range allowAttrs[tag] {
+		if a.Key == k && a.Namespace == "" {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if a.Key == "href" || a.Key == "src" {
+		u, err := url.Parse(strings.TrimSpace(a.Val))
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "", "http", "https", "mailto":
+			return true
+		}
+		return false
+	}
+	if a.Key == "target" {
+		return a.Val == "_blank" || a.Val == "_self"
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package ecgo
+
+import (
+	"testing"
+)
+
+func TestStripTags(t *testing.T) {
+	cases := map[string]string{
+		"plain":                                  "plain",
+		"<b>bold</b> text":                       "bold text",
+		"a<script>alert(1)</script>b":            "ab",
+		"&lt;img src=x onerror=alert(1)&gt;":     "&lt;img src=x onerror=alert(1)&gt;",
+		"&amp;lt;script&amp;gt;":                 "&amp;lt;script&amp;gt;",
+		`<p title="x">"q" & 'a'</p>`:             "&#34;q&#34; &amp; &#39;a&#39;",
+		"1 > 0":                                  "1 &gt; 0",
+		"<a href='javascript:x'>&#60;b&#62;</a>": "&lt;b&gt;",
+	}
+	for in, want := range cases {
+		if got := stripTags(in); got != want {
+			t.Errorf("stripTags(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	allow := map[string]bool{"p": true, "a": true, "img": true, "b": true}
+	cases := map[string]string{
+		`<p onclick="x">hi</p>`:                    "<p>hi</p>",
+		`<a href="javascript:alert(1)">x</a>`:      "<a>x</a>",
+		`<a href="/u?a=1&b=2" target="_top">x</a>`: `<a href="/u?a=1&amp;b=2">x</a>`,
+		`<img src=x onerror=alert(1)>`:             `<img src="x" />`,
+		`&lt;img src=x onerror=alert(1)&gt;`:       "&lt;img src=x onerror=alert(1)&gt;",
+		`<b>open`:                                  "<b>open</b>",
+		`<div><script>x</script>t</div>`:           "t",
+	}
+	for in, want := range cases {
+		if got := sanitizeHTML(in, allow); got != want {
+			t.Errorf("sanitizeHTML(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -35,20 +35,23 @@
 //	func (this *C) Action() {
 //		//this.Render("a.tpl",data)
 //	}
-//
 package ecgo
 
 import (
 	. "github.com/tim1020/ecgo/dao"
 	. "github.com/tim1020/ecgo/util"
 	"html/template"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"os"
+	"sync"
 	"time"
 )
 
 //框架方法接口，用来判断dispatch时传递的对象是否组合了框架的核心方法
 type EcgoApper interface {
-	Render(tpl string, data interface{})
+	Render(tpl string, data interface{}) error
 	SetHeader(key, val string)
 	SetCookie(c ...interface{}) error
 	Redirect(url string)
@@ -59,7 +62,7 @@ type EcgoApper interface {
 	sessionSave()
 	newSession(s SessionHandler)
 	newStats()
-	parseReq()
+	parseReq() error
 	dispatch(w http.ResponseWriter, r *http.Request)
 }
 
@@ -75,13 +78,26 @@ type SessionHandler interface {
 
 //服务对象，生命周期为整个程序运行时,服务启动时创建
 type Application struct {
-	Log           *Log                          //日志操作对象
-	Conf          map[string]string             //配置内容项
-	stats         *stats                        //统计器对象
-	sessHandler   SessionHandler                //session处理器
-	viewTemplates map[string]*template.Template //编译过的模板字典
-	controller    EcgoApper
-	mutex         bool
+	Log         *Log                  //日志操作对象
+	Conf        Config                //配置内容项
+	stats       *stats                //统计器对象
+	sessHandler SessionHandler        //session处理器
+	viewEngines map[string]ViewEngine //视图引擎(按模板扩展名)
+	viewLoaded  bool                  //模板是否已载入过
+	funcMap     template.FuncMap      //应用添加的模板函数
+	embedViews  fs.FS                 //内嵌的模板文件
+	embedStatic fs.FS                 //内嵌的静态文件
+	statics     []*staticMount        //静态文件挂载点
+	compress    *compressConf
+	filter      *filterConf   //输入过滤，没有配置时为nil
+	storage     UploadStorage //按upload.storage配置创建的存储
+	userStorage UploadStorage //SetUploadStorage指定的存储
+	controller  EcgoApper
+	lock        sync.RWMutex //保护Conf和statics的替换
+	userSess    bool         //sessHandler是否由应用指定
+	subscribers []confSubscriber
+	mysql       *sharedDB  //共用的mysql连接池
+	dbLock      sync.Mutex //保护mysql的创建和引用计数
 }
 
 //请求会话对象，生命周期为一次请求，请求到达时创建
@@ -91,12 +107,15 @@ type Request struct {
 	appId        string
 	sessionOn    bool
 
+	Conf        Config         //本次请求使用的配置(请求开始时的快照，重载配置不影响进行中的请求)
+	sessHandler SessionHandler //请求开始时的sessionHandler
+
 	ResWriter *resWriter
 	Req       *http.Request
 
 	UpFile       map[string][]UpFile    //存放上传的文件信息
-	Get          map[string]string      //存放Get参数
-	Post         map[string]string      //存放Post/put参数
+	Get          map[string]string      //存放Get参数，同名参数以request_sep串接，全部值用GetAll读取
+	Post         map[string]string      //存放Post/put参数，同名参数以request_sep串接，全部值用PostAll读取
 	Cookie       map[string]string      //存放cookie
 	Header       map[string]string      //存放header
 	Session      map[string]interface{} //存放session
@@ -104,8 +123,13 @@ type Request struct {
 	ActionName   string                 //path中的资源名称
 	ActionParams []string               //path中资源的id列表
 
+	getValues  url.Values  //Get参数(开启[filter]时为过滤后的值)
+	postValues url.Values  //Post参数(开启[filter]时为过滤后的值)
+	paramErrs  ParamErrors //GetInt等读取参数时的格式错误
+
 	mcDao    *Mc
 	mysqlDao *MySQL
+	mysqlRef *sharedDB //mysqlDao使用的连接池，请求结束时释放
 }
 
 //上传文件信息结构
@@ -113,15 +137,28 @@ type UpFile struct {
 	Error int    //错误码，没有错误时为0
 	Name  string //上传原始的文件名
 	Size  int64  //文件大小
-	Type  string //文件content-type
-	Temp  string //上传后保存在服务器的临时文件路径
+	Type  string //按文件内容识别的content-type
+	Temp  string //上传后保存在服务器的临时文件路径，请求结束时删除
+	Path  string //SaveTo后的文件路径
+	Key   string //在存储中的key，storage=temp时为相对upload.path的临时文件路径
+	URL   string //存储返回的访问url
+
+	StorageErr error    //Error为UPLOAD_ERR_STORAGE时的错误信息
+	Variants   []UpFile //按[image.字段名]配置生成的缩略图
+
+	filePerm os.FileMode
+	dirPerm  os.FileMode
+	storage  UploadStorage
 }
 
 //自定义responseWriter,增加Length和Code
 type resWriter struct {
 	http.ResponseWriter
-	Length int
-	Code   int
+	Length    int //输出的字节数，开启压缩时为压缩后的大小(请求结束时确定)
+	RawLength int //压缩前的字节数
+	Code      int
+	written   bool            //是否已输出过响应
+	cw        *compressWriter //开启压缩时的压缩层
 }
 
 //计数器
@@ -5,8 +5,6 @@ package ecgo
 import (
 	"fmt"
 	. "github.com/tim1020/ecgo/util"
-	"net/http"
-	"os"
 	"reflect"
 )
 
@@ -39,22 +37,6 @@ func (this *Request) defaultHandler(c EcgoApper) {
 	this.Log.Write(LL_SYS, "[%s]control %s finish", this.appId, this.ActionName)
 }
 
-//静态文件服务
-func (this *Request) staticHandler() {
-	path := this.Req.URL.Path
-	this.Log.Write(LL_SYS, "[%s]match static , path=%s", this.appId, path)
-	file := this.Conf["static_path"] + path
-	//todo: 缓存，content-type白名单
-	f, err := os.Open(file)
-	if err != nil && os.IsNotExist(err) { //自定义404
-		this.ShowErr(404, fmt.Sprintf("File %s Not Found!", path))
-		return
-	}
-	defer f.Close()
-	staticHandler := http.FileServer(http.Dir(this.Conf["static_path"]))
-	staticHandler.ServeHTTP(this.ResWriter, this.Req)
-}
-
 //显示运行状态
 func (this *Request) statsHandler() {
 	this.SetHeader("content-type", "text/html;chartset=utf8")
@@ -0,0 +1,377 @@
+//上传图片的处理：按字段在[image.字段名]中配置，上传成功后检查尺寸、重新编码(去掉EXIF)并生成缩略图
+//
+//	[image.avatar]
+//	min_width=64            尺寸限制，不符合时Error为UPLOAD_ERR_IMAGE_SIZE
+//	max_width=4096
+//	min_height=64
+//	max_height=4096
+//	thumbs=200x200,64x64c   缩略图尺寸，保持比例缩放到框内，以c结尾时缩放后居中裁剪为指定尺寸
+//	strip_exif=on           重新编码原图，去掉EXIF等元数据(按EXIF方向旋转)
+//	format=jpeg             输出格式jpeg|png，缺省与原图相同(gif/webp输出png)
+//	quality=85              jpeg质量1-100
+//
+//缩略图保存在UpFile.Variants中，与原图一样写入临时文件并保存到存储
+
+package ecgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//解码前允许的最大像素数，防止超大图片耗尽内存
+const maxImagePixels = 50000000
+
+//图片处理规则
+type imageRule struct {
+	minWidth, maxWidth   int
+	minHeight, maxHeight int
+	thumbs               []thumbSize
+	stripExif            bool
+	format               string
+	quality              int
+}
+
+type thumbSize struct {
+	width, height int
+	crop          bool
+}
+
+func (this thumbSize) String() string {
+	return fmt.Sprintf("%dx%d", this.width, this.height)
+}
+
+//读取字段的图片处理规则，没有配置时返回nil
+func parseImageRule(conf map[string]string, field string) (rule *imageRule, err error) {
+	key := "image." + field + "."
+	found := false
+	for k := range conf {
+		if strings.HasPrefix(k, key) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	rule = &imageRule{stripExif: confOr(conf, key+"strip_exif", "on") == "on", format: conf[key+"format"]}
+	ints := []struct {
+		name string
+		val  *int
+		def  string
+	}{
+		{"min_width", &rule.minWidth, "0"},
+		{"max_width", &rule.maxWidth, "0"},
+		{"min_height", &rule.minHeight, "0"},
+		{"max_height", &rule.maxHeight, "0"},
+		{"quality", &rule.quality, "85"},
+	}
+	for _, i := range ints {
+		if *i.val, err = strconv.Atoi(confOr(conf, key+i.name, i.def)); err != nil || *i.val < 0 {
+			return nil, fmt.Errorf("%s%s: %s not a number", key, i.name, conf[key+i.name])
+		}
+	}
+	if rule.quality < 1 || rule.quality > 100 {
+		return nil, fmt.Errorf("%squality: expect 1-100", key)
+	}
+	if rule.format != "" && rule.format != "jpeg" && rule.format != "png" {
+		return nil, fmt.Errorf("%sformat: expect jpeg or png", key)
+	}
+	for _, s := range strings.Split(conf[key+"thumbs"], ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		t := thumbSize{crop: strings.HasSuffix(s, "c")}
+		wh := strings.SplitN(strings.TrimSuffix(s, "c"), "x", 2)
+		if len(wh) == 2 {
+			t.width, err = strconv.Atoi(wh[0])
+			if err == nil {
+				t.height, err = strconv.Atoi(wh[1])
+			}
+		}
+		if len(wh) != 2 || err != nil || t.width < 1 || t.height < 1 {
+			return nil, fmt.Errorf("%sthumbs: invalid size %s, expect WxH or WxHc", key, s)
+		}
+		rule.thumbs = append(rule.thumbs, t)
+	}
+	return
+}
+
+//检查配置中全部的图片处理规则
+func checkImageRules(conf map[string]string) (errs []string) {
+	fields := make(map[string]bool)
+	for k := range conf {
+		if strings.HasPrefix(k, "image.") && strings.Count(k, ".") >= 2 {
+			fields[k[len("image."):strings.LastIndex(k, ".")]] = true
+		}
+	}
+	for f := range fields {
+		if _, err := parseImageRule(conf, f); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return
+}
+
+//按规则处理上传的图片(uf.Temp)，失败时设置uf.Error，缩略图保存到storage
+func processImage(uf *UpFile, rule *imageRule, conf map[string]string, storage UploadStorage) {
+	f, err := os.Open(uf.Temp)
+	if err != nil {
+		uf.Error = UPLOAD_ERR_CANT_WRITE
+		return
+	}
+	defer f.Close()
+	cfg, srcFormat, err := image.DecodeConfig(f)
+	if err != nil {
+		uf.Error = UPLOAD_ERR_IMAGE
+		return
+	}
+	orientation := 1
+	if srcFormat == "jpeg" {
+		f.Seek(0, io.SeekStart)
+		orientation = exifOrientation(f)
+	}
+	width, height := cfg.Width, cfg.Height
+	if orientation >= 5 { //按旋转后的宽高检查
+		width, height = height, width
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels ||
+		width < rule.minWidth || height < rule.minHeight ||
+		(rule.maxWidth > 0 && width > rule.maxWidth) || (rule.maxHeight > 0 && height > rule.maxHeight) {
+		uf.Error = UPLOAD_ERR_IMAGE_SIZE
+		return
+	}
+	if !rule.stripExif && rule.format == "" && len(rule.thumbs) == 0 {
+		return
+	}
+	f.Seek(0, io.SeekStart)
+	img, _, err := image.Decode(f)
+	if err != nil {
+		uf.Error = UPLOAD_ERR_IMAGE
+		return
+	}
+	format := rule.format
+	if format == "" {
+		format = srcFormat
+		if format != "jpeg" {
+			format = "png"
+		}
+	}
+	img = orientImage(img, orientation)
+	//gif没有EXIF，不指定格式时保留原图(动画)
+	if (rule.format != "" && rule.format != srcFormat) || (rule.stripExif && srcFormat != "gif") {
+		if err := writeImage(uf.Temp, img, format, rule.quality); err != nil {
+			uf.Error = UPLOAD_ERR_CANT_WRITE
+			return
+		}
+		uf.Name = imageName(uf.Name, "", format)
+		uf.Type = "image/" + format
+		if st, err := os.Stat(uf.Temp); err == nil {
+			uf.Size = st.Size()
+		}
+	}
+	for _, t := range rule.thumbs {
+		v := UpFile{Error: UPLOAD_ERR_OK, Name: imageName(uf.Name, "_"+t.String(), format), Type: "image/" + format,
+			filePerm: uf.filePerm, dirPerm: uf.dirPerm}
+		tf, fname, err := newUpTemp(conf, uf.dirPerm)
+		if err != nil {
+			v.Error = UPLOAD_ERR_TEMP
+			uf.Variants = append(uf.Variants, v)
+			continue
+		}
+		v.Temp = tf.Name()
+		tf.Close()
+		if err := writeImage(v.Temp, resizeImage(img, t), format, rule.quality); err != nil {
+			v.Error = UPLOAD_ERR_CANT_WRITE
+		} else if st, err := os.Stat(v.Temp); err == nil {
+			v.Size = st.Size()
+			storeUpFile(&v, fname, storage)
+		}
+		uf.Variants = append(uf.Variants, v)
+	}
+}
+
+//按格式编码写入文件，jpeg时透明部分以白色填充
+func writeImage(name string, img image.Image, format string, quality int) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "jpeg":
+		bg := image.NewRGBA(img.Bounds())
+		draw.Draw(bg, bg.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(bg, bg.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(f, bg, &jpeg.Options{Quality: quality})
+	default:
+		err = png.Encode(f, img)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//缩放：保持比例缩放到框内(不放大)，crop时缩放到覆盖整个框后居中裁剪
+func resizeImage(img image.Image, t thumbSize) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	sw, sh := float64(t.width)/float64(w), float64(t.height)/float64(h)
+	if !t.crop {
+		s := sw
+		if sh < s {
+			s = sh
+		}
+		if s > 1 {
+			s = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, clampInt(int(float64(w)*s+0.5), 1, w), clampInt(int(float64(h)*s+0.5), 1, h)))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+		return dst
+	}
+	s := sw
+	if sh > s {
+		s = sh
+	}
+	//原图中裁剪的区域
+	cw, ch := clampInt(int(float64(t.width)/s+0.5), 1, w), clampInt(int(float64(t.height)/s+0.5), 1, h)
+	x, y := b.Min.X+(w-cw)/2, b.Min.Y+(h-ch)/2
+	dst := image.NewRGBA(image.Rect(0, 0, t.width, t.height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, image.Rect(x, y, x+cw, y+ch), draw.Src, nil)
+	return dst
+}
+
+func clampInt(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+//生成文件名：加上后缀，扩展名改为输出格式
+func imageName(name, suffix, format string) string {
+	ext := "." + format
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	old := filepath.Ext(name)
+	base := strings.TrimSuffix(name, old)
+	if suffix == "" && strings.EqualFold(old, ".jpeg") && format == "jpeg" {
+		ext = old
+	}
+	return base + suffix + ext
+}
+
+//读取jpeg中EXIF的方向(1-8)，没有时返回1
+func exifOrientation(r io.Reader) int {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || head != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 || marker[1] == 0xDA { //图像数据开始，没有EXIF
+			return 1
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && len(data) > 14 && string(data[:6]) == "Exif\x00\x00" {
+			o, _ := tiffOrientation(data[6:])
+			return o
+		}
+	}
+}
+
+//从TIFF结构的IFD0中读取Orientation(0x0112)
+func tiffOrientation(tiff []byte) (int, error) {
+	var order binary.ByteOrder
+	if len(tiff) < 8 {
+		return 1, errors.New("invalid tiff header")
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1, errors.New("invalid tiff header")
+	}
+	off64 := int64(order.Uint32(tiff[4:8])) //在int64中计算，避免32位平台溢出
+	if off64+2 > int64(len(tiff)) {
+		return 1, errors.New("invalid ifd offset")
+	}
+	off := int(off64)
+	n := int(order.Uint16(tiff[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o, nil
+			}
+		}
+	}
+	return 1, nil
+}
+
+//按EXIF方向旋转/翻转图片
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { //宽高互换
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
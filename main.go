@@ -1,30 +1,35 @@
 package ecgo
 
 import (
-	"bytes"
-	"errors"
-	"fmt"
 	. "github.com/tim1020/ecgo/util"
 	"github.com/tim1020/godaemon"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+//启动服务，等同于 New(c, sess).Run()
 func Server(c EcgoApper, sess SessionHandler) (err error) {
-	conf, err := LoadConf(confFile...)
+	return New(c, sess).Run()
+}
+
+//创建应用对象(读取配置，初始化日志、session和统计)，需要AddFuncMap等设置时，先New再Run
+func New(c EcgoApper, sess SessionHandler) *Application {
+	initEnv()
+	files := confFiles()
+	conf, err := LoadConf(files...)
 	checkError(err)
 	err = checkConf(conf)
 	checkError(err)
 	logger := NewLogger(conf["log.level"], conf["log.path"])
+	checkError(logger.SetFormat(conf["log.format"]))
+	checkError(logger.SetOutput(conf["log.output"]))
+	checkError(logger.SetRotate(logRotate(conf)))
 	logger.Write(LL_SYS, "Applicatoin server start")
-	logger.Write(LL_SYS, "LoadConf:")
+	logger.Write(LL_SYS, "LoadConf: env=%s, files=%v", Env, files)
 	logger.Write(LL_SYS, "====>")
 	for k, v := range conf {
 		logger.Write(LL_SYS, "%s=%v", k, v)
@@ -32,19 +37,37 @@ func Server(c EcgoApper, sess SessionHandler) (err error) {
 	logger.Write(LL_SYS, "<====")
 
 	app := &Application{
-		Conf:          conf,
-		Log:           logger,
-		viewTemplates: make(map[string]*template.Template),
+		Conf:        conf,
+		Log:         logger,
+		viewEngines: make(map[string]ViewEngine),
+		funcMap:     make(template.FuncMap),
 	}
-	err = app.buildTemplate()
-	checkError(err)
+	app.statics, _ = parseStaticMounts(conf)
+	app.compress, _ = parseCompress(conf)
+	app.filter, _ = parseFilter(conf)
+	app.storage, _ = newUploadStorage(conf)
 	app.newSession(sess)
 	app.newStats()
 	app.controller = c
+	app.confSubscribe()
+	return app
+}
+
+//编译模板并开始监听服务
+func (this *Application) Run() (err error) {
+	err = this.buildTemplate()
+	checkError(err)
+	this.loadManifests(this.statics)
+	conf := this.config()
+	if conf["auto_reload"] == "on" {
+		this.watch()
+	}
 	//接入godaemon
 	mux1 := http.NewServeMux()
-	mux1.HandleFunc("/", app.dispatch)
-	log.Fatalln(godaemon.GracefulServe(app.Conf["listen"], mux1))
+	mux1.HandleFunc("/", this.dispatch)
+	err = godaemon.GracefulServe(conf["listen"], mux1)
+	this.Log.Close() //写入缓冲中的日志
+	log.Fatalln(err)
 	return
 }
 
@@ -53,49 +76,78 @@ func (this *Application) dispatch(w http.ResponseWriter, r *http.Request) {
 	if strings.ToLower(r.RequestURI) == "/favicon.ico" {
 		return
 	}
+	this.lock.RLock()
 	req := &Request{
 		appId:       Md5(time.Now().UnixNano(), 8),
 		Bm:          NewBenchMark(),
 		Application: this,
-		ResWriter:   &resWriter{w, 0, 200},
+		Conf:        this.Conf,
+		sessHandler: this.sessHandler,
+		ResWriter:   &resWriter{ResponseWriter: w, Code: 200},
 		Req:         r,
 	}
+	this.lock.RUnlock()
 	this.Log.Write(LL_SYS, "[%s]request reach,dispatch start, path=%s", req.appId, r.URL.Path)
 
 	//统计服务
-	if this.Conf["stats_page"] == "on" && strings.ToLower(r.RequestURI) == "/stats" {
+	if req.Conf["stats_page"] == "on" && strings.ToLower(r.RequestURI) == "/stats" {
 		req.statsHandler()
 		return
 	}
+	//响应压缩
+	this.lock.RLock()
+	compress := this.compress
+	this.lock.RUnlock()
+	if compress != nil {
+		req.ResWriter.cw = newCompressWriter(w, r, compress)
+		req.ResWriter.ResponseWriter = req.ResWriter.cw
+	}
 	//请求结束时的处理
 	defer req.finish()
 	//静态文件服务
-	if strings.HasPrefix(r.URL.Path, this.Conf["static_prefix"]) { //静态
-		req.staticHandler()
+	if m := this.matchStatic(r.URL.Path); m != nil { //静态
+		req.staticHandler(m)
 		return
 	}
 	//处理请求参数
-	req.parseReq()
+	if err := req.parseReq(); err != nil {
+		req.ShowErr(http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		return
+	}
 	//开启session
-	if this.Conf["session.auto_start"] == "on" {
+	if req.Conf["session.auto_start"] == "on" {
 		req.SessionStart()
 	}
 	//处理action
 	req.defaultHandler(this.controller)
 }
 
-//获取conf的值
+//获取conf的值，指定defaultVal且key不存在时设置为缺省值
 func (this *Application) GetConf(key string, defaultVal ...string) (val string, exists bool) {
-	if len(defaultVal) != 0 {
-		setConfDefault(this.Conf, key, defaultVal[0])
-	}
+	this.lock.RLock()
 	val, exists = this.Conf[key]
+	this.lock.RUnlock()
+	if exists || len(defaultVal) == 0 {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	//取得写锁前可能已被其它请求设置；复制后替换，不修改请求正在使用的快照
+	if val, exists = this.Conf[key]; !exists {
+		conf := make(Config, len(this.Conf)+1)
+		for k, v := range this.Conf {
+			conf[k] = v
+		}
+		conf[key] = defaultVal[0]
+		this.Conf = conf
+		val, exists = defaultVal[0], true
+	}
 	return
 }
 
-//重载配置
+//重载配置，读取和检查都成功时才替换
 func (this *Application) reloadConf() {
-	conf, err := LoadConf(confFile...)
+	conf, err := LoadConf(confFiles()...)
 	if err == nil {
 		err = checkConf(conf)
 	}
@@ -108,87 +160,48 @@ func (this *Application) reloadConf() {
 		this.Log.Write(LL_SYS, "%s=%s", k, v)
 	}
 	this.Log.Write(LL_SYS, "===>")
+	statics, _ := parseStaticMounts(conf)
+	this.loadManifests(statics)
+	compress, _ := parseCompress(conf)
+	filter, _ := parseFilter(conf)
+	storage, _ := newUploadStorage(conf)
+	this.lock.Lock()
+	old := this.Conf
 	this.Conf = conf
+	this.statics = statics
+	this.compress = compress
+	this.filter = filter
+	this.storage = storage
+	this.lock.Unlock()
+	this.notifyConfChange(old, conf)
 }
 
-//载入模板
-func (this *Application) buildTemplate() (err error) {
-	files, _ := ioutil.ReadDir(viewPath)
-	need := false
-	for _, f := range files { //遍历模板目录,
-		if f.IsDir() {
-			continue
-		}
-		file := viewPath + f.Name()
-		stat, _ := os.Stat(file)
-		if stat.ModTime().Unix() > viewMTime { //有新文件
-			need = true
-			this.Log.Write(LL_SYS, "build template")
-			break
-		}
-	}
-	var errs []string
-	if need {
-		for _, f := range files { //遍历编译
-			file := viewPath + f.Name()
-			mf, err := os.Open(file)
-			if err != nil {
-				this.Log.E("template fail: can not open file %s", f.Name())
-				errs = append(errs, fmt.Sprintf("读取模板文件失败: file=%s", f.Name()))
-				continue
-			}
-			defer mf.Close()
-			content, _ := ioutil.ReadAll(mf)
-			reg := regexp.MustCompile(`\{\{#include "(.*)"\}\}`)
-			//遍历引用的子文件
-			var notExistsIncFile []string
-			for _, v := range reg.FindAllSubmatch(content, -1) { //遍历匹配到的内容进行替换
-				incFile := fmt.Sprintf("%s/%s", viewPath, v[1]) //同一层目录
-				f1, err := os.Open(incFile)
-				if err != nil {
-					ifile := string(v[1])
-					errs = append(errs, fmt.Sprintf("读取include模板文件失败： file=%s, include=%s", f.Name(), ifile))
-					notExistsIncFile = append(notExistsIncFile, ifile)
-					break
-				}
-				defer f1.Close()
-				incContent, _ := ioutil.ReadAll(f1)
-				content = bytes.Replace(content, v[0], incContent, 1)
-			}
-			if len(notExistsIncFile) > 0 {
-				this.Log.E("template fail: can not open include file, file=%s, include=(%s)", f.Name(), strings.Join(notExistsIncFile, ","))
-			} else {
-				this.Log.Write(LL_SYS, "template file=%s,ok", f.Name())
-				this.viewTemplates[f.Name()], _ = template.New(f.Name()).Parse(string(content))
-			}
-		}
-		viewMTime = time.Now().Unix()
-	}
-	if len(errs) > 0 { //有错
-		err = errors.New(strings.Join(errs, "\n"))
-	}
-	return
-}
-
-//初始化一个内置的sessionHandler
+//初始化sessionHandler，s为nil时使用按session.handler配置的内置处理器
 func (this *Application) newSession(s SessionHandler) {
 	this.Log.Write(LL_SYS, "new session")
 	if s != nil {
 		this.sessHandler = s
+		this.userSess = true
 	} else {
-		switch this.Conf["session.handler"] {
-		case "file":
-			this.sessHandler = &fileSession{log: this.Log}
-		case "memcache":
-			this.sessHandler = &mcSession{log: this.Log}
-		}
+		this.sessHandler = newSessionHandler(this.Conf["session.handler"], this.Log)
+	}
+}
+
+//内置的sessionHandler
+func newSessionHandler(handler string, logger *Log) SessionHandler {
+	switch handler {
+	case "file":
+		return &fileSession{log: logger}
+	case "memcache":
+		return &mcSession{log: logger}
 	}
+	return nil
 }
 
 //初始化状态统计
 func (this *Application) newStats() {
 	this.Log.Write(LL_SYS, "new stats")
-	interval, _ := strconv.ParseInt(this.Conf["stats_interval"], 10, 64)
+	interval := this.Conf.Int64("stats_interval", 30)
 	this.stats = &stats{
 		uptime:  time.Now(),
 		pv:      &counter{interval: interval},
@@ -199,6 +212,11 @@ func (this *Application) newStats() {
 //请求结束时的处理
 func (this *Request) finish() {
 	this.sessionSave()
+	this.ResWriter.close()
+	this.cleanUpload()
+	if this.mysqlRef != nil {
+		this.releaseMySQL(this.mysqlRef)
+	}
 	go func() {
 		//耗时统计
 		this.Bm.Set("dispatch_end")
@@ -225,6 +243,8 @@ func (this *Request) finish() {
 					logs = append(logs, strconv.Itoa(this.ResWriter.Code))
 				case "size":
 					logs = append(logs, strconv.Itoa(this.ResWriter.Length))
+				case "raw_size":
+					logs = append(logs, strconv.Itoa(this.ResWriter.RawLength))
 				case "execute_time":
 					logs = append(logs, strconv.FormatInt(tTotal, 10))
 				case "ua":
@@ -237,21 +257,9 @@ func (this *Request) finish() {
 					logs = append(logs, "-")
 				}
 			}
-			this.Log.Write(LL_ACCESS, strings.Join(logs, this.Conf["log.access_log_sep"]))
+			this.Log.Write(LL_ACCESS, "%s", strings.Join(logs, this.Conf["log.access_log_sep"]))
 		}
 
-		if !this.mutex {
-			this.mutex = true
-			this.reloadConf()           //如有需要，重载配置
-			err := this.buildTemplate() //如有需要，重编译模板
-			this.mutex = false
-			if err != nil {
-				eMsg := err.Error()
-				for _, str := range strings.Split(eMsg, "\n") {
-					this.Log.E(str)
-				}
-			}
-		}
 		this.statsIncrease() //统计计数器增加
 	}()
 }
@@ -0,0 +1,59 @@
+//多层文件系统：按顺序在各层中查找文件，前面的层覆盖后面的同名文件
+//
+//用于把磁盘目录叠加在内嵌(embed.FS)的views、public之上，开发时修改磁盘文件即可生效，部署时只需单个执行文件
+
+package ecgo
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+)
+
+type overlayFS []fs.FS
+
+//磁盘目录dir叠加在内嵌文件系统embed之上，embed为nil时只使用磁盘目录
+func newOverlayFS(dir string, embed fs.FS) overlayFS {
+	layers := overlayFS{os.DirFS(dir)}
+	if embed != nil {
+		layers = append(layers, embed)
+	}
+	return layers
+}
+
+func (this overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range this {
+		if f, err := layer.Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+//合并各层的目录内容，同名时以前面的层为准
+func (this overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	found := false
+	for _, layer := range this {
+		list, err := fs.ReadDir(layer, name)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, e := range list {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
@@ -0,0 +1,321 @@
+//请求参数的读取：同名参数的全部值，以及PHP风格的嵌套参数
+//
+//	a=1&a=2                        GetAll("a") => ["1" "2"]
+//	tags[]=x&tags[]=y              GetAll("tags[]") => ["x" "y"]，GetAll("tags")在没有tags参数时也返回这两个值
+//	user[name]=tim&user[age]=18    GetParams()["user"] => map[name:tim age:18]
+//	items[0][id]=1&items[1][id]=2  GetParams()["items"] => [map[id:1] map[id:2]]
+//
+//嵌套参数中，下标为从0开始的连续整数时解码为[]interface{}，否则为map[string]interface{}，值为string；
+//普通参数重复时使用最后一个值
+//
+//按类型读取，参数不存在或为空时返回缺省值，格式错误时也返回缺省值并记录错误，可在最后统一检查：
+//
+//	page := this.GetInt("page", 1)
+//	from := this.GetTime("from", "2006-01-02", time.Time{})
+//	id := this.Param(0)
+//	if err := this.ParamErr(); err != nil {
+//		this.ShowErr(400, err.Error())
+//		return
+//	}
+
+package ecgo
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//嵌套参数的最大层数，超出部分作为最后一层key的一部分
+const maxParamDepth = 10
+
+//读取Get参数的全部值(不串接)，key不存在时尝试key[]
+func (this *Request) GetAll(key string) []string {
+	return valuesAll(this.getValues, key)
+}
+
+//读取Post参数的全部值(不串接)，key不存在时尝试key[]
+func (this *Request) PostAll(key string) []string {
+	return valuesAll(this.postValues, key)
+}
+
+//Get参数按PHP风格的key解码为嵌套的map/slice
+func (this *Request) GetParams() map[string]interface{} {
+	return decodeParams(this.getValues)
+}
+
+//Post参数按PHP风格的key解码为嵌套的map/slice
+func (this *Request) PostParams() map[string]interface{} {
+	return decodeParams(this.postValues)
+}
+
+//参数格式错误
+type ParamError struct {
+	Source string //get, post 或 param
+	Key    string
+	Value  string
+	Err    error
+}
+
+func (this *ParamError) Error() string {
+	return fmt.Sprintf("%s param %s=%q: %s", this.Source, this.Key, this.Value, this.Err.Error())
+}
+
+func (this *ParamError) Unwrap() error {
+	return this.Err
+}
+
+//多个参数错误
+type ParamErrors []*ParamError
+
+func (this ParamErrors) Error() string {
+	msgs := make([]string, len(this))
+	for i, e := range this {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//读取参数时记录的格式错误(ParamErrors)，没有错误时返回nil
+func (this *Request) ParamErr() error {
+	if len(this.paramErrs) == 0 {
+		return nil
+	}
+	return this.paramErrs
+}
+
+//ActionParams中的第i个参数(从0开始)，不存在时返回空串
+func (this *Request) Param(i int) string {
+	if i < 0 || i >= len(this.ActionParams) {
+		return ""
+	}
+	return this.ActionParams[i]
+}
+
+//GetInt Get参数的整数值，不存在或为空时返回def，格式错误时返回def并记录到ParamErrors
+func (this *Request) GetInt(key string, def int) int {
+	return int(this.parseInt("get", this.getValues, key, int64(def), strconv.IntSize))
+}
+
+//GetInt64 同GetInt，返回int64
+func (this *Request) GetInt64(key string, def int64) int64 {
+	return this.parseInt("get", this.getValues, key, def, 64)
+}
+
+//GetFloat Get参数的浮点数值
+func (this *Request) GetFloat(key string, def float64) float64 {
+	return this.parseFloat("get", this.getValues, key, def)
+}
+
+//GetBool 可识别1/0, true/false, on/off, yes/no
+func (this *Request) GetBool(key string, def bool) bool {
+	return this.parseBool("get", this.getValues, key, def)
+}
+
+//GetTime 按layout解析时间(使用本地时区)，layout为空时可识别unix时间戳、RFC3339、"2006-01-02 15:04:05"和"2006-01-02"
+func (this *Request) GetTime(key, layout string, def time.Time) time.Time {
+	return this.parseTime("get", this.getValues, key, layout, def)
+}
+
+//PostInt Post参数的整数值，规则同GetInt
+func (this *Request) PostInt(key string, def int) int {
+	return int(this.parseInt("post", this.postValues, key, int64(def), strconv.IntSize))
+}
+
+//PostInt64 同PostInt，返回int64
+func (this *Request) PostInt64(key string, def int64) int64 {
+	return this.parseInt("post", this.postValues, key, def, 64)
+}
+
+//PostFloat Post参数的浮点数值
+func (this *Request) PostFloat(key string, def float64) float64 {
+	return this.parseFloat("post", this.postValues, key, def)
+}
+
+//PostBool 可识别的值同GetBool
+func (this *Request) PostBool(key string, def bool) bool {
+	return this.parseBool("post", this.postValues, key, def)
+}
+
+//PostTime 按layout解析时间，规则同GetTime
+func (this *Request) PostTime(key, layout string, def time.Time) time.Time {
+	return this.parseTime("post", this.postValues, key, layout, def)
+}
+
+//参数值(重复时取最后一个)，不存在或为空时ok为false
+func paramValue(vals url.Values, key string) (val string, ok bool) {
+	v := valuesAll(vals, key)
+	if len(v) == 0 {
+		return "", false
+	}
+	val = strings.TrimSpace(v[len(v)-1])
+	return val, val != ""
+}
+
+func (this *Request) paramErr(source, key, val string, err error) {
+	if ne, ok := err.(*strconv.NumError); ok {
+		err = ne.Err
+	}
+	this.paramErrs = append(this.paramErrs, &ParamError{Source: source, Key: key, Value: val, Err: err})
+}
+
+func (this *Request) parseInt(source string, vals url.Values, key string, def int64, bits int) int64 {
+	val, ok := paramValue(vals, key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(val, 10, bits)
+	if err != nil {
+		this.paramErr(source, key, val, err)
+		return def
+	}
+	return n
+}
+
+func (this *Request) parseFloat(source string, vals url.Values, key string, def float64) float64 {
+	val, ok := paramValue(vals, key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		this.paramErr(source, key, val, err)
+		return def
+	}
+	return f
+}
+
+func (this *Request) parseBool(source string, vals url.Values, key string, def bool) bool {
+	val, ok := paramValue(vals, key)
+	if !ok {
+		return def
+	}
+	switch strings.ToLower(val) {
+	case "1", "true", "on", "yes":
+		return true
+	case "0", "false", "off", "no":
+		return false
+	}
+	this.paramErr(source, key, val, errors.New("invalid bool"))
+	return def
+}
+
+func (this *Request) parseTime(source string, vals url.Values, key, layout string, def time.Time) time.Time {
+	val, ok := paramValue(vals, key)
+	if !ok {
+		return def
+	}
+	if layout != "" {
+		t, err := time.ParseInLocation(layout, val, time.Local)
+		if err != nil {
+			this.paramErr(source, key, val, errors.New("invalid time, expect "+layout))
+			return def
+		}
+		return t
+	}
+	if ts, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(ts, 0)
+	}
+	for _, l := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(l, val, time.Local); err == nil {
+			return t
+		}
+	}
+	this.paramErr(source, key, val, errors.New("invalid time"))
+	return def
+}
+
+func valuesAll(vals url.Values, key string) []string {
+	if v, exists := vals[key]; exists {
+		return v
+	}
+	return vals[key+"[]"]
+}
+
+//解码嵌套参数
+func decodeParams(vals url.Values) map[string]interface{} {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) //结果与map遍历顺序无关
+	root := make(map[string]interface{})
+	for _, k := range keys {
+		path := splitParamKey(k)
+		for _, v := range vals[k] {
+			setParam(root, path, v)
+		}
+	}
+	for k, v := range root { //顶层始终为map
+		root[k] = toSlices(v)
+	}
+	return root
+}
+
+//拆分key：user[name][0] => [user name 0]，[]为空字符串(追加)
+func splitParamKey(key string) []string {
+	i := strings.IndexByte(key, '[')
+	if i <= 0 || !strings.HasSuffix(key, "]") {
+		return []string{key}
+	}
+	path := []string{key[:i]}
+	rest := key[i:]
+	for len(rest) > 0 && rest[0] == '[' && len(path) < maxParamDepth {
+		j := strings.IndexByte(rest, ']')
+		if j < 0 {
+			break
+		}
+		path = append(path, rest[1:j])
+		rest = rest[j+1:]
+	}
+	if rest != "" { //格式不正确或层数过多时，剩余部分并入最后一层
+		path[len(path)-1] += rest
+	}
+	return path
+}
+
+//按路径设置值，中间层不是map时覆盖
+func setParam(m map[string]interface{}, path []string, val string) {
+	for i, p := range path {
+		if p == "" { //[]追加，使用当前元素个数作为下标
+			p = strconv.Itoa(len(m))
+		}
+		if i == len(path)-1 {
+			m[p] = val
+			return
+		}
+		child, ok := m[p].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[p] = child
+		}
+		m = child
+	}
+}
+
+//下标为0..n-1的map转为slice(递归)
+func toSlices(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	for k, c := range m {
+		m[k] = toSlices(c)
+	}
+	list := make([]interface{}, len(m))
+	for k, c := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(m) || strconv.Itoa(i) != k {
+			return m
+		}
+		list[i] = c
+	}
+	if len(list) == 0 {
+		return m
+	}
+	return list
+}
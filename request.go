@@ -3,9 +3,13 @@
 package ecgo
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	. "github.com/tim1020/ecgo/util"
 	"io"
+	"io/fs"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,41 +25,74 @@ const (
 	UPLOAD_ERR_TYPE_NOTALLOW //不允许的类型
 	UPLOAD_ERR_TEMP          //临时目录不可用
 	UPLOAD_ERR_CANT_WRITE    //文件写入失败
+	UPLOAD_ERR_TYPE_MISMATCH //扩展名与文件内容不符
+	UPLOAD_ERR_STORAGE       //保存到存储失败
+	UPLOAD_ERR_IMAGE         //不是可处理的图片([image.字段名]中配置的字段)
+	UPLOAD_ERR_IMAGE_SIZE    //图片尺寸不符合要求
+	UPLOAD_ERR_CHUNK         //分块上传的块，未检查类型，只能由ChunkUpload接收合并
 )
 
+//multipart请求中非文件字段可使用的最大内存
+const maxFormMemory = 10 << 20
+
+//请求体超出upload.max_body
+var errBodyTooLarge = errors.New("request body too large")
+
 /**
  * 对http请求进行格式化处理, 并将结果存入App的成员变量 Get/Post/Cookie/Header/UpFile
+ *
+ * 请求体超出upload.max_body时返回errBodyTooLarge
  */
-func (this *Request) parseReq() {
+func (this *Request) parseReq() (err error) {
 	this.Log.Write(LL_SYS, "[%s]parse request start", this.appId)
 	this.Bm.Set("parse_req_start")
 	defer func() {
 		this.Bm.Set("parse_req_end")
 		this.Log.Write(LL_SYS, "[%s]parse request finish", this.appId)
 	}()
+	if maxBody, _ := strconv.ParseInt(this.Conf["upload.max_body"], 10, 64); maxBody > 0 {
+		this.Req.Body = http.MaxBytesReader(this.ResWriter, this.Req.Body, maxBody)
+	}
 	m := false
 	ct := this.Req.Header.Get("Content-Type")
 	if strings.HasPrefix(ct, "multipart/form-data") {
 		m = true
-		this.Req.ParseMultipartForm(10 << 20)
+		this.UpFile, err = getFile(this.Req, this.Conf, this.uploadStorage())
 	} else if strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
-		this.Req.ParseForm()
+		err = this.Req.ParseForm()
+	}
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) || errors.Is(err, multipart.ErrMessageTooLarge) {
+			this.Log.W("[%s]request body too large: %s", this.appId, err.Error())
+			return errBodyTooLarge
+		}
+		this.Log.W("[%s]parse body fail: %s", this.appId, err.Error())
+		err = nil
 	}
 	this.Header = getHeader(this.Req)
 	this.Cookie = getCookie(this.Req)
-	this.Get = getGet(this.Req)
-	this.Post = getPost(this.Req, m)
-	if m {
-		this.UpFile = getFile(this.Req, this.Conf)
-	}
+	this.Get, this.getValues = getGet(this.Req, this.Conf["request_sep"])
+	this.Post, this.postValues = getPost(this.Req, m, this.Conf["request_sep"])
 	this.Method = this.Req.Method
 	this.ActionName, this.ActionParams = parsePath(this.Req, this.Conf)
+	//输入过滤，只替换Get/Post及getValues/postValues，this.Req中保留原始值
+	this.lock.RLock()
+	filter := this.filter
+	this.lock.RUnlock()
+	if filter != nil {
+		this.getValues = filter.filterValues(this.ActionName, this.getValues)
+		this.postValues = filter.filterValues(this.ActionName, this.postValues)
+		this.Get = joinValues(this.getValues, this.Conf["request_sep"])
+		this.Post = joinValues(this.postValues, this.Conf["request_sep"])
+	}
 
 	this.Log.Write(LL_SYS, "[%s]method=%s, actionName=%s,actionParams=%s", this.appId, this.Method, this.ActionName, this.ActionParams)
 	this.Log.Write(LL_SYS, "[%s]get =>%v", this.appId, this.Get)
 	this.Log.Write(LL_SYS, "[%s]post =>%v", this.appId, this.Post)
 	this.Log.Write(LL_SYS, "[%s]cookie =>%v", this.appId, this.Cookie)
 	this.Log.Write(LL_SYS, "[%s]file =>%v", this.appId, this.UpFile)
+	return
 }
 
 //处理path
@@ -109,85 +146,189 @@ func getCookie(req *http.Request) (cookie map[string]string) {
 	return
 }
 
-//获取GET参数，同名参数内容以req_sep串接
-func getGet(req *http.Request) (get map[string]string) {
-	get = make(map[string]string)
-	q, _ := url.ParseQuery(req.URL.RawQuery)
-	for k, v := range q {
-		k = strings.TrimSuffix(k, "[]") //如果是xxx[]方式的key,只保留xx,所以 xx和xx[]会相互覆盖
-		get[k] = strings.Join(v, RequestSep)
-	}
-	return
+//获取GET参数，同名参数内容以req_sep串接，vals为原始的参数
+func getGet(req *http.Request, sep string) (get map[string]string, vals url.Values) {
+	vals, _ = url.ParseQuery(req.URL.RawQuery)
+	return joinValues(vals, sep), vals
 }
 
-//获取post参数,m表示是否multiPart方式请求,同名参数内容以req_sep串接
-func getPost(req *http.Request, m bool) (post map[string]string) {
-	post = make(map[string]string)
-	var vals url.Values
+//获取post参数,m表示是否multiPart方式请求,同名参数内容以req_sep串接，vals为原始的参数
+func getPost(req *http.Request, m bool, sep string) (post map[string]string, vals url.Values) {
 	if m && req.MultipartForm != nil {
 		vals = req.MultipartForm.Value
 	} else {
 		vals = req.PostForm
 	}
+	if vals == nil {
+		vals = url.Values{}
+	}
+	return joinValues(vals, sep), vals
+}
+
+//同名参数内容以sep串接
+func joinValues(vals url.Values, sep string) map[string]string {
+	m := make(map[string]string)
 	for k, v := range vals {
 		k = strings.TrimSuffix(k, "[]") //如果是xxx[]方式的key,只保留xx,所以 xx和xx[]会相互覆盖
-		post[k] = strings.Join(v, RequestSep)
+		m[k] = strings.Join(v, sep)
 	}
-	return
+	return m
 }
 
-//处理上传文件
-func getFile(req *http.Request, conf map[string]string) map[string][]UpFile {
-	f := make(map[string][]UpFile)
-	if req.MultipartForm != nil {
-		for k, v := range req.MultipartForm.File { //k为上传字段
-			k = strings.TrimSuffix(k, "[]") //如果是xxx[]方式的key,只保留xx,所以 xx和xx[]会相互覆盖
-			for _, v1 := range v {
-				mime := v1.Header.Get("Content-Type")
-				uf := UpFile{Error: UPLOAD_ERR_OK, Name: v1.Filename, Type: mime}
-				if conf["upload.allow_mime"] != "all" && !strings.Contains(conf["upload.allow_mime"], mime) {
-					uf.Error = UPLOAD_ERR_TYPE_NOTALLOW
-					f[k] = append(f[k], uf)
-					continue
-				}
-				file, _ := v1.Open()
-				defer file.Close()
-				fname := Md5(time.Now().UnixNano())
-				fpath := fmt.Sprintf("%s/%s/%s/", conf["path"], fname[:2], fname[2:4])
-				if err := os.MkdirAll(fpath, os.ModePerm); err != nil {
-					uf.Error = UPLOAD_ERR_TEMP
-					f[k] = append(f[k], uf)
-					continue
-				}
-				tmp := fpath + fname[4:]
-				f1, err := os.Create(tmp)
-				if err != nil {
-					uf.Error = UPLOAD_ERR_TEMP
-					f[k] = append(f[k], uf)
-					continue
-				}
-				size, err := io.Copy(f1, file)
-				if err != nil {
-					uf.Error = UPLOAD_ERR_CANT_WRITE
-					f[k] = append(f[k], uf)
-					continue
-				}
-				f1.Close()
-				mSize, _ := strconv.ParseInt(conf["upload.max_size"], 10, 64)
-				if size > mSize {
-					uf.Error = UPLOAD_ERR_SIZE_OVERFLOW
-					f[k] = append(f[k], uf)
-					os.Remove(tmp)
-					continue
-				}
-				uf.Size = size
-				uf.Temp = tmp
-				f[k] = append(f[k], uf)
+//处理上传文件：逐个读取multipart的part，普通字段存入req.MultipartForm.Value，文件边读边写入临时文件
+func getFile(req *http.Request, conf map[string]string, storage UploadStorage) (f map[string][]UpFile, err error) {
+	f = make(map[string][]UpFile)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return
+	}
+	form := &multipart.Form{Value: make(map[string][]string)}
+	req.MultipartForm = form
+	maxSize, _ := strconv.ParseInt(conf["upload.max_size"], 10, 64)
+	memory := int64(maxFormMemory)
+	chunk := req.URL.Query().Get(chunkIdParam) != "" //分块上传，upload_id在query中或在文件之前的字段中
+	for {
+		part, err := mr.NextPart() //会丢弃上一个part未读完的内容
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			return f, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if part.FileName() == "" { //普通字段
+			b, err := io.ReadAll(io.LimitReader(part, memory+1))
+			if err != nil {
+				return f, err
+			}
+			if memory -= int64(len(b)); memory < 0 {
+				return f, multipart.ErrMessageTooLarge
 			}
+			form.Value[name] = append(form.Value[name], string(b))
+			if name == chunkIdParam && len(b) > 0 {
+				chunk = true
+			}
+			continue
+		}
+		k := strings.TrimSuffix(name, "[]") //如果是xxx[]方式的key,只保留xx,所以 xx和xx[]会相互覆盖
+		rule, _ := parseImageRule(conf, k)
+		uf, err := saveUpFile(part, conf, maxSize, storage, chunk, rule)
+		f[k] = append(f[k], uf)
+		if err != nil {
+			return f, err
 		}
-		//fmt.Printf("%q", f)
 	}
-	return f
 }
 
-//TODO: XSS处理
+//把上传的文件写入临时文件，超出maxSize时停止写入并删除临时文件，storage不为nil时再保存到storage
+//
+//文件类型按内容识别(不使用客户端提供的content-type)，upload.check_ext=on时扩展名须与内容一致；
+//rule不为nil时按规则处理图片；chunk为true(分块上传的块)时不检查类型和处理图片，也不保存到storage，
+//Error设为UPLOAD_ERR_CHUNK(SaveTo/Open不可用)，由ChunkUpload合并后再检查和处理
+//
+//返回的err为读取请求体的错误(如超出upload.max_body)，其它错误记录在uf.Error中
+func saveUpFile(part *multipart.Part, conf map[string]string, maxSize int64, storage UploadStorage, chunk bool, rule *imageRule) (uf UpFile, err error) {
+	uf = UpFile{Error: UPLOAD_ERR_OK, Name: part.FileName()}
+	uf.filePerm, _ = parsePerm(conf["upload.file_perm"])
+	uf.dirPerm, _ = parsePerm(conf["upload.dir_perm"])
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return
+	}
+	head = head[:n]
+	if !chunk && !checkUpType(&uf, head, conf) {
+		return uf, nil
+	}
+	f1, fname, err := newUpTemp(conf, uf.dirPerm)
+	if err != nil {
+		uf.Error = UPLOAD_ERR_TEMP
+		return uf, nil
+	}
+	tmp := f1.Name()
+	size, err := io.Copy(f1, io.LimitReader(io.MultiReader(bytes.NewReader(head), part), maxSize+1))
+	f1.Close()
+	if err != nil {
+		os.Remove(tmp)
+		var pe *fs.PathError
+		if errors.As(err, &pe) { //写文件出错
+			uf.Error = UPLOAD_ERR_CANT_WRITE
+			return uf, nil
+		}
+		return
+	}
+	if size > maxSize {
+		uf.Error = UPLOAD_ERR_SIZE_OVERFLOW
+		os.Remove(tmp)
+		return
+	}
+	uf.Size = size
+	uf.Temp = tmp
+	if chunk {
+		uf.Error = UPLOAD_ERR_CHUNK
+		return
+	}
+	finishUpFile(&uf, fname, rule, conf, storage)
+	return
+}
+
+//临时文件写入完成后的处理：按规则处理图片，再保存到storage
+func finishUpFile(uf *UpFile, fname string, rule *imageRule, conf map[string]string, storage UploadStorage) {
+	if rule != nil {
+		processImage(uf, rule, conf, storage)
+		if uf.Error != UPLOAD_ERR_OK {
+			os.Remove(uf.Temp)
+			uf.Temp = ""
+			return
+		}
+	}
+	storeUpFile(uf, fname, storage)
+}
+
+//按文件头识别类型并检查是否允许，不允许时设置uf.Error并返回false
+func checkUpType(uf *UpFile, head []byte, conf map[string]string) bool {
+	uf.Type = detectMime(head)
+	if !mimeAllowed(uf.Type, conf["upload.allow_mime"]) {
+		uf.Error = UPLOAD_ERR_TYPE_NOTALLOW
+		return false
+	}
+	if conf["upload.check_ext"] == "on" && !extMatchMime(uf.Name, uf.Type) {
+		uf.Error = UPLOAD_ERR_TYPE_MISMATCH
+		return false
+	}
+	return true
+}
+
+//在upload.path下创建临时文件，fname为随机的文件名
+func newUpTemp(conf map[string]string, dirPerm os.FileMode) (f *os.File, fname string, err error) {
+	fname = Md5(time.Now().UnixNano())
+	fpath := fmt.Sprintf("%s/%s/%s/", conf["upload.path"], fname[:2], fname[2:4])
+	if err = os.MkdirAll(fpath, dirPerm); err != nil {
+		return
+	}
+	f, err = os.OpenFile(fpath+fname[4:], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	return
+}
+
+//把临时文件保存到storage，设置Key和URL，storage为nil时Key为临时文件的相对路径
+func storeUpFile(uf *UpFile, fname string, storage UploadStorage) {
+	if storage == nil {
+		uf.Key = fmt.Sprintf("%s/%s/%s", fname[:2], fname[2:4], fname[4:])
+		return
+	}
+	key := uploadKey(uf.Name, fname)
+	f, err := os.Open(uf.Temp)
+	if err == nil {
+		defer f.Close()
+		uf.URL, err = storage.Put(key, f, uf.Size, uf.Type)
+	}
+	if err != nil {
+		uf.Error = UPLOAD_ERR_STORAGE
+		uf.StorageErr = err
+		return
+	}
+	uf.Key, uf.storage = key, storage
+}
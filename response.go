@@ -3,9 +3,11 @@
 package ecgo
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	. "github.com/tim1020/ecgo/util"
+	"html/template"
 	"net/http"
 	"strconv"
 	"time"
@@ -14,11 +16,23 @@ import (
 func (this *resWriter) Write(b []byte) (n int, err error) {
 	n, err = this.ResponseWriter.Write(b)
 	this.Length += n
+	this.RawLength += n
+	this.written = true
 	return
 }
 func (this *resWriter) WriteHeader(code int) {
 	this.ResponseWriter.WriteHeader(code)
 	this.Code = code
+	this.written = true
+}
+
+//结束输出：关闭压缩层，Length更新为实际输出的字节数
+func (this *resWriter) close() {
+	if this.cw == nil {
+		return
+	}
+	this.cw.Close()
+	this.Length = this.cw.written
 }
 
 //在响应中添加Header,在body输出前调用
@@ -67,40 +81,65 @@ func (this Request) Redirect(url string) {
 	http.Redirect(this.ResWriter, this.Req, url, http.StatusFound)
 }
 
-//响应一个错误,可在view目录放置以statusCode为名称的模板,没有模板时，使用内置格式显示
+//响应一个错误,可在view目录放置以statusCode为名称的模板,没有模板或模板执行失败时，使用内置格式显示
 func (this *Request) ShowErr(statusCode int, msg string) {
-	this.ResWriter.WriteHeader(statusCode)
 	code := strconv.Itoa(statusCode)
-	if t, exists := this.viewTemplates[code]; exists {
-		data := map[string]string{"statusCode": code, "message": msg}
-		t.Execute(this.ResWriter, data)
-	} else {
-		html := `<!DOCTYPE html>
-			<html lang="zh-CN">
-			<head><title>%s</title></head>
-			<body>
-			<h2>%d %s</h2><li>%s
-			</body>
-			</html>
-		`
-		sText := http.StatusText(statusCode)
-		fmt.Fprintf(this.ResWriter, html, sText, statusCode, sText, msg)
+	data := map[string]string{"statusCode": code, "message": msg}
+	b, err := this.RenderToBytes(code, data)
+	if err == nil {
+		this.ResWriter.WriteHeader(statusCode)
+		this.ResWriter.Write(b)
+		return
 	}
+	if !errors.Is(err, ErrViewNotFound) {
+		this.Log.E("[%s]error page render fail: %s", this.appId, err.Error())
+	}
+	html := `<!DOCTYPE html>
+		<html lang="zh-CN">
+		<head><title>%s</title></head>
+		<body>
+		<h2>%d %s</h2><li>%s
+		</body>
+		</html>
+	`
+	sText := http.StatusText(statusCode)
+	this.ResWriter.WriteHeader(statusCode)
+	fmt.Fprintf(this.ResWriter, html, sText, statusCode, sText, template.HTMLEscapeString(msg))
 }
 
 //渲染模板并输出(模板存放在RootPath下的views目录)
-func (this *Request) Render(tplName string, data interface{}) {
+//
+//先渲染到缓冲区，成功后才输出；模板不存在或执行出错时记录日志(含模板名和行号)，响应500错误页并返回错误
+func (this *Request) Render(tplName string, data interface{}) (err error) {
 	this.Log.Write(LL_SYS, "[%s]render start,tplName=%s,data=%v", this.appId, tplName, data)
 	this.Bm.Set("render_start")
 	defer func() {
 		this.Bm.Set("render_end")
 		this.Log.Write(LL_SYS, "[%s]render finish", this.appId)
 	}()
-	if t, exists := this.viewTemplates[tplName]; exists {
-		t.Execute(this.ResWriter, data)
-	} else {
-		fmt.Fprintf(this.ResWriter, "tpl not found")
+	b, err := this.RenderToBytes(tplName, data)
+	if err != nil {
+		this.Log.E("[%s]render fail: tpl=%s, %s", this.appId, tplName, err.Error())
+		this.ShowErr(500, "Template Render Error")
+		return
 	}
+	_, err = this.ResWriter.Write(b)
+	return
+}
+
+//渲染模板并返回结果(不输出)，可用于邮件内容、局部模板等
+func (this *Application) RenderToBytes(tplName string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := this.viewEngine(tplName).Render(&buf, tplName, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//渲染模板并以字符串返回
+func (this *Application) RenderString(tplName string, data interface{}) (string, error) {
+	b, err := this.RenderToBytes(tplName, data)
+	return string(b), err
 }
 
 //使用格式化字串输出响应
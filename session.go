@@ -12,7 +12,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 )
 
@@ -34,7 +33,7 @@ func (this *Request) SessionStart() {
 	this.sessHandler.Open(sid, this.Conf)
 	this.Session = this.sessHandler.Read()
 	cookie := &http.Cookie{Name: this.Conf["session.sid"], Value: sid, HttpOnly: true}
-	ct, _ := strconv.Atoi(this.Conf["session.cookie_lifetime"])
+	ct := this.Conf.Int("session.cookie_lifetime", 0)
 	if ct > 0 {
 		cookie.Expires = time.Now().Add(time.Second * time.Duration(ct))
 	}
@@ -42,10 +41,10 @@ func (this *Request) SessionStart() {
 	this.sessionOn = true
 	//gc
 	go func() {
-		gd, _ := strconv.Atoi(this.Conf["session.gc_divisor"])
+		gd := this.Conf.Int("session.gc_divisor", 10)
 		if gd > 1 && rand.Intn(gd) == 0 {
 			this.Log.Write(LL_SYS, "[%s]gc call", this.appId)
-			gt, _ := strconv.ParseInt(this.Conf["session.gc_lifetime"], 10, 64)
+			gt := this.Conf.Int64("session.gc_lifetime", 36000)
 			this.sessHandler.Gc(gt)
 			return
 		}
@@ -0,0 +1,455 @@
+//静态文件服务：按扩展名设置缓存头、强ETag、预压缩文件(.br/.gz)、MIME白名单，缺省不允许列目录
+//
+//可在配置中用[static.名称]设置多个挂载点，每个挂载点可单独设置缓存策略和访问控制:
+//
+//	[static.uploads]
+//	prefix=/uploads/       ;url前缀
+//	path=/data/upload      ;目录，相对路径时相对应用根目录
+//	cache=*:3600           ;其它选项缺省使用static_cache,static_allow_mime,static_precompress,static_list_dir
+//	auth=CheckLogin        ;访问前调用controller的方法(同PreControl)，方法中已输出响应(如ShowErr,Redirect)时不再继续
+//
+//没有设置[static.*]时，使用static_prefix和static_path作为唯一的挂载点
+//
+//磁盘目录中的文件优先，其次是内嵌的静态文件(SetStaticFS)
+//
+//挂载点根目录下存在assets.json(由 ecgo assets 生成)时，模板函数static使用其中带内容指纹的文件名，
+//这些带指纹的文件以一年的immutable缓存输出
+
+package ecgo
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	. "github.com/tim1020/ecgo/util"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//静态文件的ETag缓存(LRU)，文件修改后重新计算
+var staticEtags = struct {
+	sync.Mutex
+	m    map[string]*list.Element
+	list *list.List //最近使用的在前
+}{m: make(map[string]*list.Element), list: list.New()}
+
+//ETag缓存的最大条数
+const staticEtagMax = 10000
+
+type staticEtagItem struct {
+	key  string
+	etag string
+}
+
+//静态文件挂载点
+type staticMount struct {
+	name        string //挂载点名称
+	prefix      string //url前缀
+	dir         string //磁盘目录
+	embedDir    string //对应的内嵌目录，为空时不使用内嵌文件
+	cache       string //缓存策略
+	allowMime   string //允许的content-type
+	precompress string //是否使用预压缩文件
+	listDir     string //是否允许列目录
+	auth        string //访问控制方法
+
+	manifest  map[string]string //assets.json: 原文件名 => 带指纹的文件名
+	immutable map[string]bool   //带指纹的文件名
+}
+
+//资源清单文件名
+const assetManifest = "assets.json"
+
+//一年，带指纹文件的缓存时间
+const immutableMaxAge = 365 * 24 * 3600
+
+//设置内嵌的静态文件系统，路径与应用根目录下相同(如//go:embed public 得到的embed.FS)，需在Run之前调用
+func (this *Application) SetStaticFS(fsys fs.FS) {
+	this.embedStatic = fsys
+}
+
+//挂载点的文件系统：磁盘目录叠加在内嵌的静态文件之上
+func (this *Application) mountFS(m *staticMount) fs.FS {
+	var embed fs.FS
+	if this.embedStatic != nil && m.embedDir != "" {
+		embed, _ = fs.Sub(this.embedStatic, m.embedDir)
+	}
+	return newOverlayFS(m.dir, embed)
+}
+
+//读取各挂载点的资源清单
+func (this *Application) loadManifests(mounts []*staticMount) {
+	for _, m := range mounts {
+		m.manifest, m.immutable = nil, nil
+		b, err := fs.ReadFile(this.mountFS(m), assetManifest)
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(b, &m.manifest); err != nil {
+			this.Log.E("asset manifest fail: mount=%s, %s", m.name, err.Error())
+			continue
+		}
+		m.immutable = make(map[string]bool)
+		for _, v := range m.manifest {
+			m.immutable[v] = true
+		}
+		this.Log.Write(LL_SYS, "asset manifest load: mount=%s, files=%d", m.name, len(m.manifest))
+	}
+}
+
+//查找与path匹配的挂载点(前缀最长的优先)
+func (this *Application) matchStatic(upath string) *staticMount {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, m := range this.statics {
+		if strings.HasPrefix(upath, m.prefix) {
+			return m
+		}
+	}
+	return nil
+}
+
+//缺省挂载点(名称为public的挂载点，没有时为第一个)，用于模板中的static函数
+func (this *Application) defaultStatic() *staticMount {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, m := range this.statics {
+		if m.name == "public" {
+			return m
+		}
+	}
+	if len(this.statics) > 0 {
+		return this.statics[0]
+	}
+	return nil
+}
+
+//从配置中读取挂载点
+func parseStaticMounts(conf map[string]string) (mounts []*staticMount, errs []string) {
+	for k := range conf {
+		if !strings.HasPrefix(k, "static.") || !strings.HasSuffix(k, ".prefix") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(k, "static."), ".prefix")
+		key := "static." + name + "."
+		m := &staticMount{name: name, prefix: conf[k], dir: conf[key+"path"]}
+		if !strings.HasPrefix(m.prefix, "/") || !strings.HasSuffix(m.prefix, "/") {
+			errs = append(errs, fmt.Sprintf("%sprefix: expect /xxx/, got %s", key, m.prefix))
+		}
+		if m.dir == "" {
+			errs = append(errs, fmt.Sprintf("%spath: required", key))
+		} else if !filepath.IsAbs(m.dir) {
+			m.embedDir = path.Clean(filepath.ToSlash(m.dir))
+			m.dir = filepath.Join(RootPath, m.dir)
+		}
+		m.cache = confOr(conf, key+"cache", conf["static_cache"])
+		if err := checkCachePolicy(m.cache); err != nil {
+			errs = append(errs, fmt.Sprintf("%scache: %s", key, err.Error()))
+		}
+		m.allowMime = confOr(conf, key+"allow_mime", conf["static_allow_mime"])
+		m.precompress = confOr(conf, key+"precompress", conf["static_precompress"])
+		m.listDir = confOr(conf, key+"list_dir", conf["static_list_dir"])
+		m.auth = conf[key+"auth"]
+		mounts = append(mounts, m)
+	}
+	if len(mounts) == 0 { //兼容static_prefix,static_path
+		prefix := conf["static_prefix"]
+		mounts = append(mounts, &staticMount{
+			name:        "public",
+			prefix:      prefix,
+			dir:         conf["static_path"] + prefix,
+			embedDir:    strings.Trim(prefix, "/"),
+			cache:       conf["static_cache"],
+			allowMime:   conf["static_allow_mime"],
+			precompress: conf["static_precompress"],
+			listDir:     conf["static_list_dir"],
+		})
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		if len(mounts[i].prefix) != len(mounts[j].prefix) {
+			return len(mounts[i].prefix) > len(mounts[j].prefix)
+		}
+		return mounts[i].name < mounts[j].name
+	})
+	return
+}
+
+//读取conf，不存在时返回def
+func confOr(conf map[string]string, key, def string) string {
+	if val, exists := conf[key]; exists {
+		return val
+	}
+	return def
+}
+
+//静态文件服务
+func (this *Request) staticHandler(m *staticMount) {
+	upath := this.Req.URL.Path
+	this.Log.Write(LL_SYS, "[%s]match static , mount=%s, path=%s", this.appId, m.name, upath)
+	if m.auth != "" && !this.staticAuth(m) {
+		return
+	}
+	name, ok := staticName("/" + strings.TrimPrefix(upath, m.prefix))
+	if !ok {
+		this.ShowErr(404, fmt.Sprintf("File %s Not Found!", upath))
+		return
+	}
+	fsys := this.mountFS(m)
+	stat, err := fs.Stat(fsys, name)
+	if err != nil { //自定义404
+		this.ShowErr(404, fmt.Sprintf("File %s Not Found!", upath))
+		return
+	}
+	if stat.IsDir() {
+		index := path.Join(name, "index.html")
+		if s, err := fs.Stat(fsys, index); err == nil && !s.IsDir() {
+			name, stat = index, s
+		} else if m.listDir == "on" {
+			this.listDir(fsys, name)
+			return
+		} else {
+			this.ShowErr(404, fmt.Sprintf("File %s Not Found!", upath))
+			return
+		}
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if !mimeAllowed(ctype, m.allowMime) {
+		this.ShowErr(403, fmt.Sprintf("File %s Forbidden!", upath))
+		return
+	}
+	header := this.ResWriter.Header()
+	if ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	immutable := m.immutable[name]
+	//客户端支持时，使用预压缩的同名.br/.gz文件
+	if m.precompress == "on" {
+		header.Add("Vary", "Accept-Encoding")
+		ae := this.Req.Header.Get("Accept-Encoding")
+		for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !acceptEncoding(ae, enc.name) {
+				continue
+			}
+			if s, err := fs.Stat(fsys, name+enc.ext); err == nil && !s.IsDir() {
+				header.Set("Content-Encoding", enc.name)
+				name, stat = name+enc.ext, s
+				break
+			}
+		}
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		this.ShowErr(404, fmt.Sprintf("File %s Not Found!", upath))
+		return
+	}
+	defer f.Close()
+	var content io.ReadSeeker
+	if rs, ok := f.(io.ReadSeeker); ok {
+		content = rs
+	} else {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			this.ShowErr(500, "File Read Error")
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+	if etag, err := staticEtag(name, stat, content); err == nil {
+		header.Set("Etag", etag)
+	}
+	if immutable {
+		header.Set("Cache-Control", "public, max-age="+strconv.Itoa(immutableMaxAge)+", immutable")
+		header.Set("Expires", time.Now().Add(immutableMaxAge*time.Second).UTC().Format(http.TimeFormat))
+	} else if sec, exists := staticCacheTime(m.cache, name); exists {
+		if sec > 0 {
+			header.Set("Cache-Control", "public, max-age="+strconv.Itoa(sec))
+			header.Set("Expires", time.Now().Add(time.Duration(sec)*time.Second).UTC().Format(http.TimeFormat))
+		} else {
+			header.Set("Cache-Control", "no-cache")
+		}
+	}
+	http.ServeContent(this.ResWriter, this.Req, name, stat.ModTime(), content)
+}
+
+//执行挂载点的访问控制方法，方法中已输出响应时返回false
+func (this *Request) staticAuth(m *staticMount) bool {
+	if err := this.parseReq(); err != nil {
+		this.ShowErr(http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		return false
+	}
+	if this.Conf["session.auto_start"] == "on" {
+		this.SessionStart()
+	}
+	rValue := reflect.ValueOf(this.controller)
+	method, exists := rValue.Type().MethodByName(m.auth)
+	if !exists {
+		this.Log.E("[%s]static auth method not found: mount=%s, auth=%s", this.appId, m.name, m.auth)
+		this.ShowErr(500, "Static Auth Error")
+		return false
+	}
+	rValue.Elem().FieldByName("Request").Set(reflect.ValueOf(this))
+	method.Func.Call([]reflect.Value{rValue})
+	return !this.ResWriter.written
+}
+
+//把url路径转为文件系统中的名称，包含..、反斜杠或空字符的路径视为非法(不依赖http.Dir的处理)
+func staticName(upath string) (string, bool) {
+	if strings.ContainsAny(upath, "\\\x00") {
+		return "", false
+	}
+	for _, seg := range strings.Split(upath, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	name := strings.Trim(upath, "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+//计算文件内容的强ETag(md5)，按文件名、修改时间和大小缓存
+func staticEtag(name string, stat fs.FileInfo, content io.ReadSeeker) (string, error) {
+	key := fmt.Sprintf("%s|%d|%d", name, stat.ModTime().UnixNano(), stat.Size())
+	staticEtags.Lock()
+	if e, exists := staticEtags.m[key]; exists {
+		staticEtags.list.MoveToFront(e)
+		etag := e.Value.(*staticEtagItem).etag
+		staticEtags.Unlock()
+		return etag, nil
+	}
+	staticEtags.Unlock()
+	h := md5.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:8])
+	staticEtags.Lock()
+	if _, exists := staticEtags.m[key]; !exists {
+		staticEtags.m[key] = staticEtags.list.PushFront(&staticEtagItem{key, etag})
+		for staticEtags.list.Len() > staticEtagMax {
+			e := staticEtags.list.Back()
+			staticEtags.list.Remove(e)
+			delete(staticEtags.m, e.Value.(*staticEtagItem).key)
+		}
+	}
+	staticEtags.Unlock()
+	return etag, nil
+}
+
+//按扩展名取缓存时间(秒)，policy格式为 "css,js:86400 png,jpg:604800 *:3600"，*为其它扩展名
+func staticCacheTime(policy, name string) (sec int, exists bool) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".br")), "."))
+	def, hasDef := 0, false
+	for _, group := range strings.Fields(policy) {
+		i := strings.LastIndex(group, ":")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(group[i+1:])
+		if err != nil {
+			continue
+		}
+		for _, e := range strings.Split(group[:i], ",") {
+			e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+			if e == ext {
+				return n, true
+			}
+			if e == "*" {
+				def, hasDef = n, true
+			}
+		}
+	}
+	return def, hasDef
+}
+
+//检查缓存策略的格式
+func checkCachePolicy(policy string) error {
+	for _, group := range strings.Fields(policy) {
+		i := strings.LastIndex(group, ":")
+		if i <= 0 {
+			return fmt.Errorf("expect ext1,ext2:seconds, got %s", group)
+		}
+		if n, err := strconv.Atoi(group[i+1:]); err != nil || n < 0 {
+			return fmt.Errorf("seconds not a number: %s", group)
+		}
+	}
+	return nil
+}
+
+//判断content-type是否在白名单中，allow为all时全部允许，支持image/*的写法
+func mimeAllowed(ctype, allow string) bool {
+	if allow == "all" {
+		return true
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		ctype = mt
+	}
+	for _, a := range strings.Split(allow, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == ctype || (strings.HasSuffix(a, "/*") && strings.HasPrefix(ctype, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+//判断Accept-Encoding中是否接受指定编码(q=0表示不接受)
+func acceptEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != enc {
+			continue
+		}
+		for _, p := range fields[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+//列出目录内容(static_list_dir=on时)
+func (this *Request) listDir(fsys fs.FS, name string) {
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		this.ShowErr(500, "Read Dir Error")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	this.SetHeader("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(this.ResWriter, "<pre>\n")
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		fmt.Fprintf(this.ResWriter, "<a href=\"%s\">%s</a>\n", template.HTMLEscapeString((&url.URL{Path: n}).String()), template.HTMLEscapeString(n)) //href需先做url转义，如文件名中的#、?
+	}
+	fmt.Fprintf(this.ResWriter, "</pre>\n")
+}
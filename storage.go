@@ -0,0 +1,297 @@
+//上传文件的存储：上传的文件先写入upload.path下的临时文件(检查大小和类型)，再交给UploadStorage保存
+//
+//	storage=temp    只保存在临时文件中，请求结束时删除(缺省)
+//	storage=local   保存到local_path目录，local_url为对应的访问url前缀
+//	storage=s3      保存到S3兼容的对象存储(path-style，如MinIO)
+//
+//应用可实现UploadStorage接口，通过SetUploadStorage使用自己的存储
+
+package ecgo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//上传文件存储接口，key为相对路径形式，如 2016/01/02/xxx.jpg
+type UploadStorage interface {
+	Put(key string, r io.Reader, size int64, ctype string) (url string, err error) //保存文件，返回访问url(没有时为空)
+	Get(key string) (io.ReadCloser, error)                                         //读取文件
+	Delete(key string) error                                                       //删除文件
+}
+
+//指定上传文件的存储，代替storage配置，需在Run之前调用
+func (this *Application) SetUploadStorage(s UploadStorage) {
+	this.userStorage = s
+}
+
+//当前使用的存储，storage=temp时为nil
+func (this *Application) uploadStorage() UploadStorage {
+	if this.userStorage != nil {
+		return this.userStorage
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.storage
+}
+
+//根椐配置创建存储
+func newUploadStorage(conf map[string]string) (UploadStorage, error) {
+	filePerm, _ := parsePerm(conf["upload.file_perm"])
+	dirPerm, _ := parsePerm(conf["upload.dir_perm"])
+	switch conf["upload.storage"] {
+	case "temp":
+		return nil, nil
+	case "local":
+		if conf["upload.local_path"] == "" {
+			return nil, errors.New("upload.local_path: required when storage=local")
+		}
+		return &localStorage{dir: conf["upload.local_path"], url: conf["upload.local_url"], filePerm: filePerm, dirPerm: dirPerm}, nil
+	case "s3":
+		s := &s3Storage{
+			endpoint: strings.TrimSuffix(conf["upload.s3_endpoint"], "/"),
+			region:   conf["upload.s3_region"],
+			bucket:   conf["upload.s3_bucket"],
+			access:   conf["upload.s3_access_key"],
+			secret:   conf["upload.s3_secret_key"],
+			url:      conf["upload.s3_url"],
+			client:   &http.Client{Timeout: 5 * time.Minute},
+		}
+		if s.endpoint == "" || s.bucket == "" || s.access == "" || s.secret == "" {
+			return nil, errors.New("upload.s3_endpoint, s3_bucket, s3_access_key, s3_secret_key: required when storage=s3")
+		}
+		if _, err := url.Parse(s.endpoint); err != nil {
+			return nil, fmt.Errorf("upload.s3_endpoint: %s", err.Error())
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("upload.storage: invalid storage %s", conf["upload.storage"])
+}
+
+//生成存储的key：日期目录加随机文件名，保留扩展名
+func uploadKey(name, id string) string {
+	ext := strings.ToLower(filepath.Ext(sanitizeFilename(name)))
+	if len(ext) > 10 {
+		ext = ""
+	}
+	return time.Now().Format("2006/01/02/") + id + ext
+}
+
+//检查key，不允许跳出存储目录
+func cleanKey(key string) (string, error) {
+	k := path.Clean("/" + key)[1:]
+	if k == "" || k != key {
+		return "", fmt.Errorf("invalid key: %s", key)
+	}
+	return k, nil
+}
+
+//url前缀与key拼接，前缀为空时返回空
+func joinUrl(prefix, key string) string {
+	if prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + key
+}
+
+//保存到本地目录
+type localStorage struct {
+	dir      string
+	url      string
+	filePerm os.FileMode
+	dirPerm  os.FileMode
+}
+
+func (this *localStorage) Put(key string, r io.Reader, size int64, ctype string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(this.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), this.dirPerm); err != nil {
+		return "", err
+	}
+	tmp := dst + ".part"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, this.filePerm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return joinUrl(this.url, key), nil
+}
+
+func (this *localStorage) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(this.dir, filepath.FromSlash(key)))
+}
+
+func (this *localStorage) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(this.dir, filepath.FromSlash(key)))
+}
+
+//保存到S3兼容的对象存储，使用path-style地址(endpoint/bucket/key)和AWS Signature V4签名
+type s3Storage struct {
+	endpoint string
+	region   string
+	bucket   string
+	access   string
+	secret   string
+	url      string //访问url前缀，为空时使用endpoint/bucket
+	client   *http.Client
+}
+
+func (this *s3Storage) Put(key string, r io.Reader, size int64, ctype string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	payload := "UNSIGNED-PAYLOAD"
+	if rs, ok := r.(io.ReadSeeker); ok { //可重复读取时签名内容
+		h := sha256.New()
+		if _, err := io.Copy(h, rs); err != nil {
+			return "", err
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		payload = hex.EncodeToString(h.Sum(nil))
+	}
+	req, err := http.NewRequest("PUT", this.objectUrl(key), r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if _, err = this.do(req, payload); err != nil {
+		return "", err
+	}
+	prefix := this.url
+	if prefix == "" {
+		prefix = this.endpoint + "/" + this.bucket
+	}
+	return joinUrl(prefix, key), nil
+}
+
+func (this *s3Storage) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", this.objectUrl(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := this.do(req, emptySha256)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (this *s3Storage) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", this.objectUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	res, err := this.do(req, emptySha256)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+//空内容的sha256
+const emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (this *s3Storage) objectUrl(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return this.endpoint + "/" + url.PathEscape(this.bucket) + "/" + strings.Join(segs, "/")
+}
+
+//签名并发送请求，非2xx响应时返回错误
+func (this *s3Storage) do(req *http.Request, payload string) (*http.Response, error) {
+	this.sign(req, payload, time.Now().UTC())
+	res, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %d %s", req.Method, req.URL.Path, res.StatusCode, string(b))
+	}
+	return res, nil
+}
+
+//AWS Signature V4
+func (this *s3Storage) sign(req *http.Request, payload string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		payload,
+	}, "\n")
+	scope := date + "/" + this.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + this.secret)
+	for _, s := range []string{date, this.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		this.access, scope, signed, hex.EncodeToString(hmacSha256(key, toSign))))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
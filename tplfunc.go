@@ -0,0 +1,259 @@
+//模板函数：内置的视图辅助函数，以及应用通过AddFuncMap添加的函数
+//
+//	{{.Ctime | date "2006-01-02"}}       格式化时间(time.Time或unix时间戳)，layout为空时使用"2006-01-02 15:04:05"
+//	{{.Price | number 2}}                 数字格式化，千分位并保留指定小数位
+//	{{url "UserList" "page" 2}}           根椐action名称生成url(反向路由)
+//	{{static "css/app.css"}}              静态文件url，使用assets.json中带指纹的文件名，没有时附带?v=指纹
+//	{{json .Data}}                        输出json
+//	{{.Name | default "guest"}}           值为空时使用缺省值
+//	{{.Title | truncate 20}}              截取指定字符数，超出部分以...表示
+//	{{.Content | nl2br}}                  转义并把换行转为<br>
+//	{{conf "site.name"}}                  读取配置项
+
+package ecgo
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/tim1020/ecgo/util"
+	"html/template"
+	"io/fs"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//静态文件的指纹缓存，文件修改后重新计算
+var assetVers = struct {
+	sync.Mutex
+	m map[string]assetVer
+}{m: make(map[string]assetVer)}
+
+type assetVer struct {
+	mtime int64
+	ver   string
+}
+
+//添加模板函数，同名时覆盖内置函数，需在Run(编译模板)之前调用
+func (this *Application) AddFuncMap(fm template.FuncMap) {
+	for k, v := range fm {
+		this.funcMap[k] = v
+	}
+}
+
+//编译模板时使用的函数表
+func (this *Application) tplFuncs() template.FuncMap {
+	fm := template.FuncMap{
+		"date":     tplDate,
+		"number":   tplNumber,
+		"url":      this.tplUrl,
+		"static":   this.tplStatic,
+		"json":     tplJson,
+		"default":  tplDefault,
+		"truncate": tplTruncate,
+		"nl2br":    tplNl2br,
+		"conf":     this.tplConf,
+	}
+	for k, v := range this.funcMap {
+		fm[k] = v
+	}
+	return fm
+}
+
+//格式化时间，t可以是time.Time或unix时间戳
+func tplDate(layout string, t interface{}) string {
+	if layout == "" {
+		layout = "2006-01-02 15:04:05"
+	}
+	switch v := t.(type) {
+	case time.Time:
+		return v.Format(layout)
+	case *time.Time:
+		if v != nil {
+			return v.Format(layout)
+		}
+	case int:
+		return time.Unix(int64(v), 0).Format(layout)
+	case int64:
+		return time.Unix(v, 0).Format(layout)
+	case string:
+		if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(ts, 0).Format(layout)
+		}
+	}
+	return ""
+}
+
+//数字格式化：千分位分隔，保留decimals位小数
+func tplNumber(decimals int, n interface{}) string {
+	var f float64
+	switch v := n.(type) {
+	case string:
+		f, _ = strconv.ParseFloat(v, 64)
+	default:
+		rv := reflect.ValueOf(n)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			f = float64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			f = rv.Float()
+		}
+	}
+	if decimals < 0 {
+		decimals = 0
+	}
+	s := strconv.FormatFloat(math.Abs(f), 'f', decimals, 64)
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i:]
+	}
+	var buf []byte
+	for i := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, intPart[i])
+	}
+	if f < 0 {
+		return "-" + string(buf) + frac
+	}
+	return string(buf) + frac
+}
+
+//反向路由：按自动路由规则，把action名称转为url，多出的参数作为query(key,val成对)
+//
+//	{{url "UserList" "page" 2}}   => /user/list?page=2
+//	RESTful时: {{url "GETUserBook" 1 2}} => /user/1/book/2
+func (this *Application) tplUrl(action string, params ...interface{}) string {
+	RESTful := this.config()["RESTful"] == "on"
+	if RESTful {
+		for _, m := range []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS"} {
+			if strings.HasPrefix(action, m) {
+				action = action[len(m):]
+				break
+			}
+		}
+	}
+	var words []string
+	start := 0
+	for i, r := range action {
+		if i > start && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(action[start:i]))
+			start = i
+		}
+	}
+	if start < len(action) {
+		words = append(words, strings.ToLower(action[start:]))
+	}
+	path := ""
+	for _, w := range words {
+		path += "/" + w
+		if RESTful && len(params) > 0 {
+			path += "/" + url.PathEscape(fmt.Sprint(params[0]))
+			params = params[1:]
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	q := url.Values{}
+	for i := 0; i+1 < len(params); i += 2 {
+		q.Add(fmt.Sprint(params[i]), fmt.Sprint(params[i+1]))
+	}
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return path
+}
+
+//静态文件url：资源清单中有时使用带指纹的文件名，否则附带文件内容的md5指纹，文件不存在时不附带
+func (this *Application) tplStatic(file string) string {
+	file = strings.TrimPrefix(file, "/")
+	m := this.defaultStatic()
+	if m == nil {
+		return "/" + file
+	}
+	if f, exists := m.manifest[file]; exists {
+		return m.prefix + f
+	}
+	u := m.prefix + file
+	fsys := this.mountFS(m)
+	path := m.name + "/" + file
+	stat, err := fs.Stat(fsys, file)
+	if err != nil {
+		return u
+	}
+	assetVers.Lock()
+	defer assetVers.Unlock()
+	v, exists := assetVers.m[path]
+	if !exists || v.mtime != stat.ModTime().UnixNano() {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return u
+		}
+		v = assetVer{stat.ModTime().UnixNano(), Md5(content, 8)}
+		assetVers.m[path] = v
+	}
+	return u + "?v=" + v.ver
+}
+
+//json编码
+func tplJson(v interface{}) (template.JS, error) {
+	b, err := json.Marshal(v)
+	return template.JS(b), err
+}
+
+//v为空值(nil,空串,0,false,空slice/map)时返回def
+func tplDefault(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
+
+//按字符数截取，超出时以...结尾
+func tplTruncate(length int, s string) string {
+	if length < 0 { //负数按0处理
+		length = 0
+	}
+	r := []rune(s)
+	if len(r) <= length {
+		return s
+	}
+	return string(r[:length]) + "..."
+}
+
+//html转义后把换行转为<br>
+func tplNl2br(s string) template.HTML {
+	s = template.HTMLEscapeString(s)
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return template.HTML(strings.Replace(s, "\n", "<br>", -1))
+}
+
+//读取配置项
+func (this *Application) tplConf(key string) string {
+	val, _ := this.GetConf(key)
+	return val
+}
@@ -0,0 +1,231 @@
+//上传文件：按内容识别文件类型，检查扩展名与类型是否一致，以及保存/读取上传文件
+//
+//	path, err := this.UpFile["avatar"][0].SaveTo("/data/avatar")  移到指定目录(使用清理后的原文件名)
+//	f, err := this.UpFile["avatar"][0].Open()                    读取上传的文件
+//	err := this.UpFile["avatar"][0].Delete()                     从存储中删除
+//
+//未SaveTo的临时文件在请求结束时删除，文件的存储见storage.go
+
+package ecgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//http.DetectContentType无法识别的文件头
+var magicTable = []struct {
+	offset int
+	magic  []byte
+	mime   string
+}{
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypheix"), "image/heic"},
+	{4, []byte("ftypmif1"), "image/heif"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{4, []byte("ftypqt"), "video/quicktime"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{0, []byte("\x7FELF"), "application/x-executable"},
+	{0, []byte("MZ"), "application/x-msdownload"},
+}
+
+//可以按内容识别的类型对应的扩展名，用于检查扩展名与内容是否一致
+var extMime = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".ico":  "image/x-icon",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".psd":  "image/vnd.adobe.photoshop",
+	".heic": "image/heic",
+	".avif": "image/avif",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".gz":   "application/x-gzip",
+	".rar":  "application/x-rar-compressed",
+	".7z":   "application/x-7z-compressed",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wave",
+	".flac": "audio/flac",
+	".ogg":  "application/ogg",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "video/avi",
+	".mov":  "video/quicktime",
+	".txt":  "text/plain",
+	".htm":  "text/html",
+	".html": "text/html",
+	".exe":  "application/x-msdownload",
+}
+
+//根椐文件头识别类型，返回不含参数的mime
+func detectMime(head []byte) string {
+	for _, m := range magicTable {
+		if len(head) >= m.offset+len(m.magic) && bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.mime
+		}
+	}
+	ctype := http.DetectContentType(head)
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		return mt
+	}
+	return ctype
+}
+
+//扩展名与识别出的类型是否一致，无法按内容识别的扩展名(如.docx,.csv)不检查
+func extMatchMime(name, ctype string) bool {
+	want, exists := extMime[strings.ToLower(filepath.Ext(name))]
+	return !exists || want == ctype
+}
+
+//清理客户端提供的文件名：去掉路径、控制字符及特殊字符，不以.开头
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if r := []rune(name); len(r) > 100 { //保留扩展名
+		ext := []rune(filepath.Ext(name))
+		if len(ext) > 20 {
+			ext = nil
+		}
+		name = string(r[:100-len(ext)]) + string(ext)
+	}
+	return name
+}
+
+//解析八进制的文件权限，如 0644
+func parsePerm(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("%s not a file mode, expect 0000-0777", s)
+	}
+	return os.FileMode(n), nil
+}
+
+//把上传的文件移到dir目录，文件名为清理后的原文件名，同名时加_1,_2..，返回保存后的路径
+func (this *UpFile) SaveTo(dir string) (path string, err error) {
+	src := this.Path
+	if src == "" {
+		src = this.Temp
+	}
+	if this.Error != UPLOAD_ERR_OK || src == "" {
+		return "", errors.New("upload file not available")
+	}
+	if err = os.MkdirAll(dir, this.dirPerm); err != nil {
+		return
+	}
+	name := sanitizeFilename(this.Name)
+	if name == "" {
+		name = filepath.Base(src)
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	var dst *os.File
+	for i := 0; ; i++ {
+		path = filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
+		}
+		dst, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, this.filePerm)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) || i >= 1000 {
+			return "", err
+		}
+	}
+	dst.Close()
+	if err = os.Rename(src, path); err != nil { //不在同一文件系统时复制
+		if err = copyFile(src, path); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		os.Remove(src)
+	}
+	os.Chmod(path, this.filePerm)
+	this.Path, this.Temp = path, ""
+	return
+}
+
+//打开上传的文件读取，本地文件已不存在时从存储中读取
+func (this *UpFile) Open() (io.ReadCloser, error) {
+	src := this.Path
+	if src == "" {
+		src = this.Temp
+	}
+	if this.Error != UPLOAD_ERR_OK {
+		return nil, errors.New("upload file not available")
+	}
+	if src != "" {
+		return os.Open(src)
+	}
+	if this.storage != nil {
+		return this.storage.Get(this.Key)
+	}
+	return nil, errors.New("upload file not available")
+}
+
+//从存储中删除文件(storage=temp时没有作用)
+func (this *UpFile) Delete() error {
+	if this.storage == nil {
+		return nil
+	}
+	return this.storage.Delete(this.Key)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+//删除未保存的临时文件，请求结束时调用
+func (this *Request) cleanUpload() {
+	for _, files := range this.UpFile {
+		for _, f := range files {
+			if f.Temp != "" {
+				os.Remove(f.Temp)
+			}
+			for _, v := range f.Variants {
+				if v.Temp != "" {
+					os.Remove(v.Temp)
+				}
+			}
+		}
+	}
+}
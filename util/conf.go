@@ -1,83 +1,336 @@
 //ini格式配置文件的读取处理
+//
+//	; 注释，也可以用 #，值后面以空白开始的 ; 或 # 为行内注释(值开头的 # 不是注释，如 color = #fff)
+//	listen = :8080            ; 行内注释
+//	[db]
+//	mysql_dsn = "user:pass@tcp(127.0.0.1:3306)/test"    双引号中可用转义 \" \\ \n \t，单引号中的内容不转义
+//	mc_server = 127.0.0.1:11211,\
+//	            127.0.0.1:11212                        行尾的 \ 表示下一行为续行
+//	slaves[] = 10.0.0.1                                key[] 为数组，用GetList读取，在配置map中以逗号串接
+//	slaves[] = 10.0.0.2
+//
+//ini文件中可用 @include 引入其它文件(也可以是yaml/toml/json文件)，相对路径以当前文件所在目录为准，可用通配符，
+//引入的内容在该位置展开，后面的配置可覆盖引入的值：
+//
+//	@include db.d/*.ini
 
 package util
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
-	"time"
 )
 
-var (
-	bComment      = []byte{';'}
-	bSectionStart = []byte{'['}
-	bSectionEnd   = []byte{']'}
-	bEqual        = []byte{'='}
-	confData      = make(map[string]map[string]string) //配置数据
-	cMtime        int64                                //配置的最后修改时间
-)
+//include的最大层数(防止循环引入)
+const maxIncludeDepth = 10
+
+//配置文件解析器，可多次Load多个文件，后面的值覆盖前面的；各Ini对象相互独立
+type Ini struct {
+	data  map[string]string
+	lists map[string][]string //key[]数组及yaml/toml/json中的列表
+	mtime map[string]int64    //读取时各文件(包括include的文件)的修改时间
+}
 
-//加载ini格式配置文件,可多个,多个文件之间有相同的key会覆盖
-//只读取一次文件，除非文件发生改变
+//生成空的Ini对象
+func NewIni() *Ini {
+	return &Ini{data: make(map[string]string), lists: make(map[string][]string), mtime: make(map[string]int64)}
+}
+
+//加载配置文件(ini，或按扩展名识别的yaml/toml/json),可多个,按参数顺序合并,后面文件中相同的key会覆盖前面的
 func LoadConf(files ...string) (map[string]string, error) {
+	ini := NewIni()
 	for _, file := range files { //遍历要读取的配置文件
-		f, err := os.Open(file)
-		if err != nil {
+		if err := ini.Load(file); err != nil {
 			return nil, err
 		}
-		defer f.Close()
-		stat, _ := f.Stat()
-		if stat.ModTime().Unix() <= cMtime { //未修改过的，不需要读
-			continue
+	}
+	return ini.Data(), nil
+}
+
+//读取配置文件，按扩展名识别格式
+func (this *Ini) Load(file string) error {
+	return this.load(file, 0)
+}
+
+//读取ini格式的内容，name用于错误信息和计算include的相对路径
+func (this *Ini) Parse(r io.Reader, name string) error {
+	return this.parse(r, name, 0)
+}
+
+//配置内容的copy，key为section.key
+func (this *Ini) Data() map[string]string {
+	data := make(map[string]string, len(this.data))
+	for k, v := range this.data {
+		data[k] = v
+	}
+	return data
+}
+
+//读取一个值，key为section.key
+func (this *Ini) Get(key string) (val string, exists bool) {
+	val, exists = this.data[key]
+	return
+}
+
+//数组的值(key[]或列表)，普通的值返回只有一个元素的slice
+func (this *Ini) GetList(key string) []string {
+	if list, exists := this.lists[key]; exists {
+		return append([]string(nil), list...)
+	}
+	if val, exists := this.data[key]; exists {
+		return []string{val}
+	}
+	return nil
+}
+
+//读取过的文件是否有修改
+func (this *Ini) Changed() bool {
+	for file, mtime := range this.mtime {
+		stat, err := os.Stat(file)
+		if err != nil || stat.ModTime().UnixNano() != mtime {
+			return true
 		}
-		//读取文件
-		confData[f.Name()] = make(map[string]string)
+	}
+	return false
+}
 
-		buf := bufio.NewReader(f)
-		section := ""
-		for ln := 1; ; ln++ {
-			line, err := buf.ReadBytes('\n')
-			if err != nil {
-				if err != io.EOF {
-					return nil, err
-				} else if len(line) == 0 {
-					break
+func (this *Ini) set(key, val string) {
+	this.data[key] = val
+	delete(this.lists, key)
+}
+
+func (this *Ini) setList(key string, list []string) {
+	this.data[key] = strings.Join(list, ",")
+	this.lists[key] = list
+}
+
+//读取ini文件
+func (this *Ini) parseFile(file string, depth int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	this.mtime[file] = stat.ModTime().UnixNano()
+	return this.parse(f, file, depth)
+}
+
+//解析ini内容，depth为include的层数
+func (this *Ini) parse(r io.Reader, file string, depth int) error {
+	lineErr := func(ln int, msg string) error {
+		if msg == "" {
+			return errors.New(fmt.Sprintf("Load conf file error: file=%s,line=%d", file, ln))
+		}
+		return fmt.Errorf("Load conf file error: file=%s,line=%d, %s", file, ln, msg)
+	}
+	buf := bufio.NewReader(r)
+	section := ""
+	arrays := make(map[string]bool) //本文件中已出现过的key[]，第一次出现时覆盖之前的值
+	cont, contLn := "", 0           //续行
+	for ln := 1; ; ln++ {
+		line, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		if eof && line == "" && cont == "" {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if cont != "" {
+			if line != "" && (line[0] == ';' || line[0] == '#') { //续行中的注释行
+				if !eof {
+					continue
 				}
+				line = ""
 			}
-			line = bytes.TrimSpace(line)
-			if line == nil || bytes.HasPrefix(line, bComment) {
+			line = cont + line
+		} else {
+			contLn = ln
+			if line == "" || line[0] == ';' || line[0] == '#' {
+				if eof {
+					break
+				}
 				continue
 			}
-			if bytes.HasPrefix(line, bSectionStart) && bytes.HasSuffix(line, bSectionEnd) {
-				section = strings.ToLower(string(line[1 : len(line)-1]))
-				continue
+		}
+		line = stripLineComment(line) //先去掉注释，注释中的\不作为续行
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && !eof {
+			cont = line[:len(line)-1]
+			continue
+		}
+		cont = ""
+		if strings.HasPrefix(line, "@include") {
+			if err := this.include(file, contLn, stripIniComment(line[len("@include"):]), depth); err != nil {
+				return err
 			}
-
-			keyValue := bytes.SplitN(line, bEqual, 2)
-			if len(keyValue) != 2 {
-				return nil, errors.New(fmt.Sprintf("Load conf file error: file=%s,line=%d", file, ln))
+		} else if strings.HasPrefix(line, "[") {
+			line = stripIniComment(line)
+			if !strings.HasSuffix(line, "]") {
+				return lineErr(contLn, "invalid section")
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+		} else {
+			keyValue := strings.SplitN(line, "=", 2)
+			if len(keyValue) != 2 || strings.TrimSpace(keyValue[0]) == "" {
+				return lineErr(contLn, "")
+			}
+			key := strings.TrimSpace(keyValue[0])
+			val, err := iniValue(keyValue[1])
+			if err != nil {
+				return lineErr(contLn, err.Error())
 			}
-			key := string(bytes.TrimSpace(keyValue[0]))
+			isArray := strings.HasSuffix(key, "[]")
+			key = strings.TrimSpace(strings.TrimSuffix(key, "[]"))
 			if section != "" {
 				key = section + "." + key
 			}
-			val := bytes.TrimSpace(keyValue[1])
-			val = bytes.Trim(val, `"'`) //如果有，去掉引号
-			confData[f.Name()][key] = string(val)
+			if isArray {
+				list := this.lists[key]
+				if !arrays[key] {
+					list, arrays[key] = nil, true
+				}
+				this.setList(key, append(list, val))
+			} else {
+				this.set(key, val)
+			}
+		}
+		if eof {
+			break
+		}
+	}
+	return nil
+}
+
+//解析值：去掉行内注释，处理引号和转义
+func iniValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	switch s[0] {
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			if c == '"' {
+				if rest := strings.TrimSpace(s[i+1:]); rest != "" && rest[0] != ';' && rest[0] != '#' {
+					return "", errors.New("unexpected content after quoted value")
+				}
+				return b.String(), nil
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				case 'r':
+					c = '\r'
+				case '"', '\\':
+					c = s[i]
+				default: //未知的转义保持原样
+					b.WriteByte('\\')
+					c = s[i]
+				}
+			}
+			b.WriteByte(c)
+		}
+		return "", errors.New("unterminated quoted value")
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated quoted value")
+		}
+		if rest := strings.TrimSpace(s[end+2:]); rest != "" && rest[0] != ';' && rest[0] != '#' {
+			return "", errors.New("unexpected content after quoted value")
+		}
+		return s[1 : end+1], nil
+	}
+	return stripIniComment(s), nil
+}
+
+//去掉一行的行内注释，值为引号字符串时引号内的 ; 和 # 不作为注释
+func stripLineComment(line string) string {
+	i := strings.IndexByte(line, '=')
+	if i < 0 || line[0] == '[' || line[0] == '@' {
+		return strings.TrimSpace(stripIniComment(line))
+	}
+	val := strings.TrimLeft(line[i+1:], " \t")
+	if val == "" {
+		return line
+	}
+	if val[0] != '"' && val[0] != '\'' { //值开头的#或;不是注释，如 color = #fff
+		return line[:len(line)-len(val)] + stripIniComment(val)
+	}
+	end := -1 //结束引号的位置
+	if val[0] == '\'' {
+		if j := strings.IndexByte(val[1:], '\''); j >= 0 {
+			end = j + 1
+		}
+	} else {
+		for j := 1; j < len(val); j++ {
+			if val[j] == '\\' {
+				j++
+			} else if val[j] == '"' {
+				end = j
+				break
+			}
 		}
 	}
-	cMtime = time.Now().Unix()
-	//获取confData的copy，因为调用者有可能会修改
-	data := make(map[string]string)
-	for _, d := range confData {
-		for k, v := range d {
-			data[k] = v
+	if end < 0 { //未结束的引号，由iniValue报错
+		return line
+	}
+	if rest := strings.TrimSpace(val[end+1:]); rest != "" && (rest[0] == ';' || rest[0] == '#') {
+		return line[:len(line)-len(val)+end+1]
+	}
+	return line
+}
+
+//去掉行内注释(前面为空白的 ; 或 #)，第一个字符不作为注释
+func stripIniComment(s string) string {
+	for i := 1; i < len(s); i++ {
+		if (s[i] == ';' || s[i] == '#') && (s[i-1] == ' ' || s[i-1] == '\t') {
+			s = s[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+//处理 @include pattern，按文件名顺序读取匹配的文件
+func (this *Ini) include(file string, ln int, pattern string, depth int) error {
+	pattern = strings.Trim(strings.TrimSpace(pattern), `"'`)
+	if pattern == "" {
+		return fmt.Errorf("Load conf file error: file=%s,line=%d, include without file", file, ln)
+	}
+	if depth >= maxIncludeDepth {
+		return fmt.Errorf("Load conf file error: file=%s,line=%d, include too deep (circular include?)", file, ln)
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("Load conf file error: file=%s,line=%d, %s", file, ln, err.Error())
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") { //没有通配符时文件必须存在
+		return fmt.Errorf("Load conf file error: file=%s,line=%d, include %s not found", file, ln, pattern)
+	}
+	for _, m := range matches {
+		if err := this.load(m, depth+1); err != nil {
+			return err
 		}
 	}
-	return data, nil
+	return nil
 }
@@ -0,0 +1,153 @@
+//yaml, toml, json格式配置文件的读取，内容展开为与ini相同的section.key形式
+//
+//	db:                         db.mysql_dsn=user:pass@/test
+//	  mysql_dsn: user:pass@/test
+//	  max_open_conns: 100       db.max_open_conns=100
+//	static:
+//	  img:
+//	    path: /data/img         static.img.path=/data/img
+//	upload:
+//	  allow_mime: [image/png, image/jpeg]     upload.allow_mime=image/png,image/jpeg
+//
+//section名转为小写，列表以逗号串接，bool值转为on/off
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reYamlLine = regexp.MustCompile(`line (\d+)`)
+
+//按扩展名读取配置文件，不是yaml/toml/json的按ini处理
+func (this *Ini) load(file string, depth int) error {
+	var decode func(data []byte) (map[string]interface{}, int, error)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		decode = decodeYaml
+	case ".toml":
+		decode = decodeToml
+	case ".json":
+		decode = decodeJson
+	default:
+		return this.parseFile(file, depth)
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	this.mtime[file] = stat.ModTime().UnixNano()
+	m, ln, err := decode(data)
+	if err != nil {
+		if ln > 0 {
+			return fmt.Errorf("Load conf file error: file=%s,line=%d, %s", file, ln, err.Error())
+		}
+		return fmt.Errorf("Load conf file error: file=%s, %s", file, err.Error())
+	}
+	for k, v := range m {
+		this.flatten(k, v)
+	}
+	return nil
+}
+
+func decodeYaml(data []byte) (m map[string]interface{}, ln int, err error) {
+	if err = yaml.Unmarshal(data, &m); err != nil {
+		if s := reYamlLine.FindStringSubmatch(err.Error()); s != nil {
+			ln, _ = strconv.Atoi(s[1])
+		}
+	}
+	return
+}
+
+func decodeToml(data []byte) (m map[string]interface{}, ln int, err error) {
+	if err = toml.Unmarshal(data, &m); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			ln = pe.Position.Line
+		}
+	}
+	return
+}
+
+func decodeJson(data []byte) (m map[string]interface{}, ln int, err error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		var offset int64
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		}
+		if offset > int64(len(data)) {
+			offset = int64(len(data))
+		}
+		ln = bytes.Count(data[:offset], []byte{'\n'}) + 1
+	}
+	return
+}
+
+//把嵌套的值展开为key => string，map的key以.连接
+func (this *Ini) flatten(key string, v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		section := strings.ToLower(key)
+		for k, c := range val {
+			this.flatten(section+"."+k, c)
+		}
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for i, c := range val {
+			switch c.(type) {
+			case map[string]interface{}, []interface{}: //复杂元素按下标展开
+				this.flatten(key+"."+strconv.Itoa(i), c)
+			default:
+				items = append(items, confString(c))
+			}
+		}
+		if len(items) > 0 || len(val) == 0 {
+			this.setList(key, items)
+		}
+	case []map[string]interface{}: //toml的表数组
+		for i, c := range val {
+			this.flatten(key+"."+strconv.Itoa(i), c)
+		}
+	default:
+		this.set(key, confString(v))
+	}
+}
+
+func confString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		if val {
+			return "on"
+		}
+		return "off"
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
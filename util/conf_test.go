@@ -0,0 +1,133 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseIni(t *testing.T, src string) *Ini {
+	ini := NewIni()
+	if err := ini.Parse(strings.NewReader(src), "test.ini"); err != nil {
+		t.Fatal(err)
+	}
+	return ini
+}
+
+func TestIniComments(t *testing.T) {
+	ini := parseIni(t, `; comment
+# comment
+listen = :8080   ; inline
+color = #fff
+bg = #000 # inline
+semi = a;b
+hash = a#b
+[DB] ; section comment
+dsn = x
+`)
+	want := map[string]string{"listen": ":8080", "color": "#fff", "bg": "#000", "semi": "a;b", "hash": "a#b", "db.dsn": "x"}
+	if got := ini.Data(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestIniQuoting(t *testing.T) {
+	ini := parseIni(t, `a = "x ; y # z"  ; c
+b = "tab\there \"q\" back\\"
+c = 'raw \n ; #'
+d = "  spaced  "
+e = ""
+`)
+	want := map[string]string{"a": "x ; y # z", "b": "tab\there \"q\" back\\", "c": `raw \n ; #`, "d": "  spaced  ", "e": ""}
+	if got := ini.Data(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+	for _, src := range []string{`a = "open`, `a = 'open`, `a = "x" y`, "novalue"} {
+		if err := NewIni().Parse(strings.NewReader(src), "bad.ini"); err == nil || !strings.Contains(err.Error(), "file=bad.ini,line=1") {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestIniContinuation(t *testing.T) {
+	ini := parseIni(t, `servers = a,\
+	b,\
+; comment between
+# another
+	c
+note = x ; comment \
+next = 2
+path = C:\\
+last = 1
+`)
+	want := map[string]string{"servers": "a,b,c", "note": "x", "next": "2", "path": `C:\\`, "last": "1"}
+	if got := ini.Data(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestIniArrays(t *testing.T) {
+	ini := NewIni()
+	ini.Parse(strings.NewReader("[s]\nips[] = 1\nips[] = 2\n"), "a.ini")
+	if got := ini.GetList("s.ips"); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("got %q", got)
+	}
+	if v, _ := ini.Get("s.ips"); v != "1,2" {
+		t.Errorf("joined %q", v)
+	}
+	//后面的文件中第一次出现时覆盖之前的数组
+	ini.Parse(strings.NewReader("[s]\nips[] = 3\n"), "b.ini")
+	if got := ini.GetList("s.ips"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("override %q", got)
+	}
+	if got := ini.GetList("nokey"); got != nil {
+		t.Errorf("missing %q", got)
+	}
+}
+
+func TestIniInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("conf.ini", "a = 1\nb = 1\n@include conf.d/*.ini\nb = main\n")
+	write("conf.d/1.ini", "[db]\ndsn = first\n")
+	write("conf.d/2.ini", "[db]\ndsn = second\na_in = 2\n")
+	write("loop.ini", "@include loop.ini\n")
+	conf, err := LoadConf(filepath.Join(dir, "conf.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1", "b": "main", "db.dsn": "second", "db.a_in": "2"}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("got %q", conf)
+	}
+	if _, err := LoadConf(filepath.Join(dir, "loop.ini")); err == nil || !strings.Contains(err.Error(), "include too deep") {
+		t.Errorf("loop: %v", err)
+	}
+	write("missing.ini", "@include none.ini\n")
+	if _, err := LoadConf(filepath.Join(dir, "missing.ini")); err == nil {
+		t.Error("missing include accepted")
+	}
+}
+
+//各Ini对象相互独立，LoadConf每次返回新的map
+func TestIniIndependent(t *testing.T) {
+	a, b := parseIni(t, "k = a\n"), parseIni(t, "k = b\n")
+	if va, _ := a.Get("k"); va != "a" {
+		t.Error(va)
+	}
+	if vb, _ := b.Get("k"); vb != "b" {
+		t.Error(vb)
+	}
+	d := a.Data()
+	d["k"] = "changed"
+	if va, _ := a.Get("k"); va != "a" {
+		t.Error("Data is not a copy")
+	}
+}
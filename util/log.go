@@ -1,18 +1,37 @@
 //日志相关操作
+//
+//日志按级别排序：sys(框架本身的日志) < debug < info < warn < error，access为访问日志(由调用者控制是否记录)，其它自定义类别按info处理。
+//level设为一个级别时记录该级别及以上的日志，如 warn 记录warn和error；设为逗号分隔的多个类别时只记录这些类别；all为全部，空值关闭全部。
+//
+//除printf风格的D/I/W/E/Write外，可用key/value记录结构化的字段：
+//
+//	this.Log.Info("user login", "uid", uid, "ip", ip)
+//	l := this.Log.With("req", reqId) //之后的日志都带上req字段
+//	l.Error("pay fail", "err", err)
+//
+//格式(SetFormat)：text(缺省，时间 消息 k=v)，json，logfmt；
+//输出(SetOutput)：file(缺省，按类别和日期保存在path下，异步写入，切分和保留见SetRotate)，stdout，syslog，tcp://host:port，udp://host:port，多个用逗号分隔
+//进程退出前调用Close以写入缓冲中的日志
 
 package util
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	LL_DEBUG  = "debug"
+	LL_INFO   = "info"
 	LL_WARN   = "warn"
 	LL_ERROR  = "error"
 	LL_SYS    = "sys"
@@ -20,19 +39,201 @@ const (
 	LL_ALL    = "all"
 )
 
+//日志格式
+const (
+	LOG_TEXT   = "text"
+	LOG_JSON   = "json"
+	LOG_LOGFMT = "logfmt"
+)
+
+//日志级别的排序
+var logSeverity = map[string]int{LL_SYS: 0, LL_DEBUG: 1, LL_INFO: 2, LL_WARN: 3, LL_ERROR: 4}
+
 type Log struct {
-	lType string //日志类别
-	path  string //日志目录，当target为file时有效
+	*logCore
+	fields []interface{} //With添加的字段
+}
+
+//同一个Log及其With生成的Log共用的设置和输出
+type logCore struct {
+	lock     sync.RWMutex
+	lType    string          //日志级别的设置
+	minLevel int             //记录的最低级别，-1表示不记录
+	types    map[string]bool //level为多个类别时，记录的类别
+	path     string          //日志目录，输出到file时有效
+	format   string
+	rotate   LogRotate //文件的切分和保留，输出到file时有效
+	outputs  []LogOutput
+}
+
+//一条日志
+type LogEntry struct {
+	Time   time.Time
+	Type   string        //日志类别(级别)
+	Msg    string        //
+	Fields []interface{} //key, value交替
+	format string
+}
+
+//日志输出
+type LogOutput interface {
+	WriteLog(e *LogEntry) error
+	Close() error
 }
 
-//生成Log对象
+//生成Log对象，输出到path目录下的文件，格式为text
 func NewLogger(lType, path string) *Log {
-	//判断日志目录是否存在，不存在时先创建
-	_, err := os.Stat(path)
-	if err != nil && os.IsNotExist(err) {
+	l := &Log{logCore: &logCore{format: LOG_TEXT, rotate: LogRotate{Period: ROTATE_DAILY}}}
+	l.SetLevel(lType)
+	l.SetPath(path)
+	l.outputs = []LogOutput{&fileOutput{core: l.logCore}}
+	return l
+}
+
+//修改日志级别，可在运行中调用
+func (this *Log) SetLevel(lType string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.lType = lType
+	this.types = nil
+	lType = strings.ToLower(strings.TrimSpace(lType))
+	switch {
+	case lType == "" || lType == "off" || lType == "none":
+		this.minLevel = -1
+	case strings.Contains(lType, ","): //多个类别
+		this.minLevel = -1
+		this.types = make(map[string]bool)
+		for _, t := range strings.Split(lType, ",") {
+			if t = strings.TrimSpace(t); t == LL_ALL {
+				this.minLevel = 0
+			} else if t != "" {
+				this.types[t] = true
+			}
+		}
+	case lType == LL_ALL:
+		this.minLevel = 0
+	default:
+		if s, exists := logSeverity[lType]; exists {
+			this.minLevel = s
+		} else {
+			this.minLevel = -1
+			this.types = map[string]bool{lType: true}
+		}
+	}
+}
+
+//修改日志目录，不存在时创建
+func (this *Log) SetPath(path string) {
+	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
 		os.MkdirAll(path, os.ModePerm)
 	}
-	return &Log{lType: lType, path: path}
+	this.lock.Lock()
+	this.path = path
+	this.lock.Unlock()
+}
+
+//修改日志格式 text|json|logfmt
+func (this *Log) SetFormat(format string) error {
+	if format == "" {
+		format = LOG_TEXT
+	}
+	if format != LOG_TEXT && format != LOG_JSON && format != LOG_LOGFMT {
+		return fmt.Errorf("invalid log format %s, expect text|json|logfmt", format)
+	}
+	this.lock.Lock()
+	this.format = format
+	this.lock.Unlock()
+	return nil
+}
+
+//按spec设置日志输出(file,stdout,syslog,tcp://host:port,udp://host:port，逗号分隔)，原来的输出被关闭
+func (this *Log) SetOutput(spec string) error {
+	var outputs []LogOutput
+	for _, s := range splitLogOutput(spec) {
+		o, err := this.newOutput(s)
+		if err != nil {
+			for _, o := range outputs {
+				o.Close()
+			}
+			return err
+		}
+		outputs = append(outputs, o)
+	}
+	this.SetOutputs(outputs...)
+	return nil
+}
+
+//设置自定义的日志输出，原来的输出被关闭
+func (this *Log) SetOutputs(outputs ...LogOutput) {
+	this.lock.Lock()
+	old := this.outputs
+	this.outputs = outputs
+	this.lock.Unlock()
+	for _, o := range old {
+		o.Close()
+	}
+}
+
+//检查日志输出的设置
+func CheckLogOutput(spec string) error {
+	for _, s := range splitLogOutput(spec) {
+		if _, _, err := parseLogOutput(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitLogOutput(spec string) (list []string) {
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	if len(list) == 0 {
+		list = []string{"file"}
+	}
+	return
+}
+
+//解析一个输出：kind为file|stdout|syslog|tcp|udp
+func parseLogOutput(s string) (kind, addr string, err error) {
+	switch s {
+	case "file", "stdout", "syslog":
+		return s, "", nil
+	}
+	if i := strings.Index(s, "://"); i > 0 {
+		kind, addr = s[:i], s[i+3:]
+		if (kind == "tcp" || kind == "udp") && addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err == nil {
+				return kind, addr, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("invalid log output %s, expect file|stdout|syslog|tcp://host:port|udp://host:port", s)
+}
+
+func (this *Log) newOutput(s string) (LogOutput, error) {
+	kind, addr, err := parseLogOutput(s)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "file":
+		return &fileOutput{core: this.logCore}, nil
+	case "stdout":
+		return &writerOutput{w: os.Stdout}, nil
+	case "syslog":
+		return newSyslogOutput()
+	}
+	return newNetOutput(kind, addr), nil
+}
+
+//生成带有固定字段的Log，与原Log共用设置和输出
+func (this *Log) With(kv ...interface{}) *Log {
+	fields := make([]interface{}, 0, len(this.fields)+len(kv))
+	fields = append(fields, this.fields...)
+	return &Log{logCore: this.logCore, fields: append(fields, kv...)}
 }
 
 //记录debug日志
@@ -40,6 +241,11 @@ func (this *Log) D(format string, vals ...interface{}) {
 	this.Write(LL_DEBUG, format, vals...)
 }
 
+//记录info日志
+func (this *Log) I(format string, vals ...interface{}) {
+	this.Write(LL_INFO, format, vals...)
+}
+
 //记录error日志
 func (this *Log) E(format string, vals ...interface{}) {
 	this.Write(LL_ERROR, format, vals...)
@@ -55,27 +261,269 @@ func (this *Log) Write(lType string, format string, vals ...interface{}) {
 	if !this.isNeed(lType) {
 		return
 	}
-	t := time.Now()
-	filepath := fmt.Sprintf("%s/%s_%s.log", this.path, lType, string(t.Format("20060102")))
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
-	if err != nil {
+	this.write(lType, time.Now(), fmt.Sprintf(format, vals...), nil)
+}
+
+//记录结构化日志，kv为key, value交替
+func (this *Log) Log(lType string, msg string, kv ...interface{}) {
+	if !this.isNeed(lType) {
 		return
 	}
-	defer file.Close()
-	wFile := bufio.NewWriter(file)
-	wFile.WriteString(string(t.Format("2006/01/02 15:04:05 ")))
-	wFile.WriteString(fmt.Sprintf(format, vals...))
-	wFile.WriteString("\n")
-	err = wFile.Flush()
-	if err != nil {
-		log.Fatalln("[err]:", err)
+	this.write(lType, time.Now(), msg, kv)
+}
+
+//记录结构化的debug日志
+func (this *Log) Debug(msg string, kv ...interface{}) {
+	this.Log(LL_DEBUG, msg, kv...)
+}
+
+//记录结构化的info日志
+func (this *Log) Info(msg string, kv ...interface{}) {
+	this.Log(LL_INFO, msg, kv...)
+}
+
+//记录结构化的warn日志
+func (this *Log) Warn(msg string, kv ...interface{}) {
+	this.Log(LL_WARN, msg, kv...)
+}
+
+//记录结构化的error日志
+func (this *Log) Error(msg string, kv ...interface{}) {
+	this.Log(LL_ERROR, msg, kv...)
+}
+
+//写入各个输出，输出失败时写到stderr
+func (this *Log) write(lType string, t time.Time, msg string, kv []interface{}) {
+	fields := this.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(fields)+len(kv)), fields...), kv...)
+	}
+	this.lock.RLock()
+	e := &LogEntry{Time: t, Type: lType, Msg: msg, Fields: fields, format: this.format}
+	outputs := this.outputs
+	this.lock.RUnlock()
+	for _, o := range outputs {
+		if err := o.WriteLog(e); err != nil {
+			fmt.Fprintf(os.Stderr, "write log fail: %s\n", err.Error())
+		}
 	}
 }
 
 //判断是否需要记录指定级别日志
 func (this *Log) isNeed(lType string) bool {
-	if lType != "LL_ACCESS" && !strings.Contains(this.lType, lType) && !strings.Contains(this.lType, LL_ALL) { //access在调用前控制
-		return false
+	if lType == LL_ACCESS { //access在调用前控制
+		return true
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.types[lType] {
+		return true
+	}
+	s, exists := logSeverity[lType]
+	if !exists {
+		s = logSeverity[LL_INFO]
+	}
+	return this.minLevel >= 0 && s >= this.minLevel
+}
+
+//按格式生成一行日志(含换行)，withType为false时text格式不输出类别(文件输出按类别分文件)
+func (this *LogEntry) Bytes(withType bool) []byte {
+	var buf bytes.Buffer
+	switch this.format {
+	case LOG_JSON:
+		buf.WriteString(`{"time":`)
+		writeJson(&buf, this.Time.Format(time.RFC3339Nano))
+		buf.WriteString(`,"type":`)
+		writeJson(&buf, this.Type)
+		buf.WriteString(`,"msg":`)
+		writeJson(&buf, this.Msg)
+		this.eachField(func(k string, v interface{}) {
+			buf.WriteByte(',')
+			writeJson(&buf, k)
+			buf.WriteByte(':')
+			writeJson(&buf, v)
+		})
+		buf.WriteByte('}')
+	case LOG_LOGFMT:
+		buf.WriteString("time=" + this.Time.Format(time.RFC3339Nano))
+		buf.WriteString(" type=" + logfmtValue(this.Type))
+		buf.WriteString(" msg=" + logfmtValue(this.Msg))
+		this.eachField(func(k string, v interface{}) {
+			buf.WriteString(" " + logfmtKey(k) + "=" + logfmtValue(fieldString(v)))
+		})
+	default:
+		buf.WriteString(this.Time.Format("2006/01/02 15:04:05 "))
+		if withType {
+			buf.WriteString("[" + this.Type + "] ")
+		}
+		buf.WriteString(this.Msg)
+		this.eachField(func(k string, v interface{}) {
+			buf.WriteString(" " + logfmtKey(k) + "=" + logfmtValue(fieldString(v)))
+		})
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+//遍历字段，key不是string时转为string，缺少value时key为!BADKEY
+func (this *LogEntry) eachField(fn func(k string, v interface{})) {
+	for i := 0; i < len(this.Fields); i += 2 {
+		if i+1 >= len(this.Fields) {
+			fn("!BADKEY", this.Fields[i])
+			return
+		}
+		fn(fieldString(this.Fields[i]), this.Fields[i+1])
+	}
+}
+
+func fieldString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case error:
+		return val.Error()
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	case time.Duration:
+		return val.String()
+	case fmt.Stringer:
+		return val.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJson(buf *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case error:
+		v = val.Error()
+	case time.Duration:
+		v = val.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func logfmtKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+//含空白、=、引号或为空时加引号
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+//输出到stdout等
+type writerOutput struct {
+	w    *os.File
+	lock sync.Mutex
+}
+
+func (this *writerOutput) WriteLog(e *LogEntry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, err := this.w.Write(e.Bytes(true))
+	return err
+}
+
+func (this *writerOutput) Close() error {
+	return nil
+}
+
+//输出到tcp/udp：由一个协程异步发送，队列满时丢弃；连接失败后netLogRetry内不再连接，期间的日志丢弃
+type netOutput struct {
+	network string
+	addr    string
+	ch      chan []byte
+	done    chan struct{}
+	lock    sync.Mutex
+	closed  bool
+	dropped int64 //丢弃的条数
+}
+
+const (
+	netLogTimeout = 3 * time.Second
+	netLogRetry   = 10 * time.Second //连接失败后重新连接的间隔
+)
+
+func newNetOutput(network, addr string) *netOutput {
+	o := &netOutput{network: network, addr: addr, ch: make(chan []byte, logQueueSize), done: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+func (this *netOutput) WriteLog(e *LogEntry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return errors.New("log output closed")
+	}
+	select {
+	case this.ch <- e.Bytes(true):
+	default: //队列满，丢弃
+		atomic.AddInt64(&this.dropped, 1)
+	}
+	return nil
+}
+
+//发送协程，连接和写入错误每logReportPeriod最多报告一次到stderr
+func (this *netOutput) run() {
+	var conn net.Conn
+	var retryTime, reportTime time.Time
+	fail := func(err error) {
+		atomic.AddInt64(&this.dropped, 1)
+		retryTime = time.Now().Add(netLogRetry)
+		if time.Since(reportTime) >= logReportPeriod {
+			fmt.Fprintf(os.Stderr, "log %s://%s: %d lines dropped, %s\n", this.network, this.addr, atomic.SwapInt64(&this.dropped, 0), err.Error())
+			reportTime = time.Now()
+		}
+	}
+	for b := range this.ch {
+		if conn == nil {
+			if time.Now().Before(retryTime) {
+				atomic.AddInt64(&this.dropped, 1)
+				continue
+			}
+			c, err := net.DialTimeout(this.network, this.addr, netLogTimeout)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			conn = c
+		}
+		conn.SetWriteDeadline(time.Now().Add(netLogTimeout))
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			conn = nil
+			fail(err)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	close(this.done)
+}
+
+//发送队列中剩余的日志后关闭
+func (this *netOutput) Close() error {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return nil
 	}
-	return true
+	this.closed = true
+	close(this.ch)
+	this.lock.Unlock()
+	<-this.done
+	return nil
 }
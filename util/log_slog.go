@@ -0,0 +1,88 @@
+//go:build go1.21
+// +build go1.21
+
+//log/slog的Handler适配，slog的日志写入Log：
+//
+//	logger := slog.New(this.Log.Handler())
+//	logger.Info("user login", "uid", uid)
+
+package util
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type slogHandler struct {
+	log   *Log
+	group string //WithGroup的前缀
+}
+
+//slog.Handler，slog的级别对应为 <Info:debug, <Warn:info, <Error:warn, 其它:error
+func (this *Log) Handler() slog.Handler {
+	return &slogHandler{log: this}
+}
+
+func slogType(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return LL_DEBUG
+	case level < slog.LevelWarn:
+		return LL_INFO
+	case level < slog.LevelError:
+		return LL_WARN
+	}
+	return LL_ERROR
+}
+
+func (this *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return this.log.isNeed(slogType(level))
+}
+
+func (this *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	kv := make([]interface{}, 0, r.NumAttrs()*2)
+	r.Attrs(func(a slog.Attr) bool {
+		kv = appendAttr(kv, this.group, a)
+		return true
+	})
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	this.log.write(slogType(r.Level), t, r.Message, kv)
+	return nil
+}
+
+func (this *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	kv := make([]interface{}, 0, len(attrs)*2)
+	for _, a := range attrs {
+		kv = appendAttr(kv, this.group, a)
+	}
+	return &slogHandler{log: this.log.With(kv...), group: this.group}
+}
+
+func (this *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return this
+	}
+	return &slogHandler{log: this.log, group: this.group + name + "."}
+}
+
+//展开属性，group中的属性key为 group.key
+func appendAttr(kv []interface{}, prefix string, a slog.Attr) []interface{} {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			kv = appendAttr(kv, prefix, ga)
+		}
+		return kv
+	}
+	if a.Key == "" {
+		return kv
+	}
+	return append(kv, prefix+a.Key, v.Any())
+}
@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+//日志输出到syslog(windows和plan9不支持)
+
+package util
+
+import (
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type syslogOutput struct {
+	w *syslog.Writer
+}
+
+//连接本机的syslog，tag为执行文件名
+func newSyslogOutput() (LogOutput, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, filepath.Base(os.Args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return &syslogOutput{w: w}, nil
+}
+
+//按日志类别选择syslog的级别
+func (this *syslogOutput) WriteLog(e *LogEntry) error {
+	msg := strings.TrimSuffix(string(e.Bytes(true)), "\n")
+	switch e.Type {
+	case LL_ERROR:
+		return this.w.Err(msg)
+	case LL_WARN:
+		return this.w.Warning(msg)
+	case LL_DEBUG, LL_SYS:
+		return this.w.Debug(msg)
+	}
+	return this.w.Info(msg)
+}
+
+func (this *syslogOutput) Close() error {
+	return this.w.Close()
+}
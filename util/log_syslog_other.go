@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package util
+
+import "errors"
+
+func newSyslogOutput() (LogOutput, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
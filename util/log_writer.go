@@ -0,0 +1,385 @@
+//日志文件的异步写入：每个日志类别一个常驻的写入协程，带缓冲，每秒及缓冲满时写入文件
+//
+//文件按时间(按天/按小时/不按时间)和大小切分，切分出的文件可gzip压缩，并按个数和天数清理；
+//写入失败(如磁盘满)时丢弃日志并每分钟最多报告一次到stderr，稍后重新打开文件，不会退出进程
+
+package util
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//按时间切分的周期
+const (
+	ROTATE_DAILY  = "daily"
+	ROTATE_HOURLY = "hourly"
+	ROTATE_NONE   = "none"
+)
+
+const (
+	logQueueSize     = 4096            //每个类别待写入的最大条数，超出时丢弃
+	logBufferSize    = 64 << 10        //写入缓冲
+	logFlushInterval = time.Second     //
+	logRetryInterval = 5 * time.Second //写入失败后重新打开文件的间隔
+	logReportPeriod  = time.Minute     //错误报告的最小间隔
+)
+
+//日志文件的切分和保留
+type LogRotate struct {
+	Period     string        //daily(缺省)|hourly|none
+	MaxSize    int64         //单个文件的最大字节数，0为不按大小切分
+	MaxBackups int           //每个类别保留的切分文件个数，0为不限
+	MaxAge     time.Duration //切分文件的保留时间，0为不限
+	Compress   bool          //是否gzip压缩切分出的文件
+}
+
+//设置日志文件的切分和保留，可在运行中调用
+func (this *Log) SetRotate(r LogRotate) error {
+	if r.Period == "" {
+		r.Period = ROTATE_DAILY
+	}
+	if r.Period != ROTATE_DAILY && r.Period != ROTATE_HOURLY && r.Period != ROTATE_NONE {
+		return fmt.Errorf("invalid log rotate %s, expect daily|hourly|none", r.Period)
+	}
+	this.lock.Lock()
+	this.rotate = r
+	this.lock.Unlock()
+	return nil
+}
+
+//把缓冲中的日志写入文件
+func (this *Log) Flush() {
+	this.lock.RLock()
+	outputs := this.outputs
+	this.lock.RUnlock()
+	for _, o := range outputs {
+		if f, ok := o.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+	}
+}
+
+//写入缓冲中的日志并关闭全部输出，进程退出前调用
+func (this *Log) Close() {
+	this.SetOutputs()
+}
+
+//输出到文件：path/类别_日期.log，每个类别一个logWriter
+type fileOutput struct {
+	core    *logCore
+	lock    sync.Mutex
+	writers map[string]*logWriter
+	closed  bool
+}
+
+func (this *fileOutput) WriteLog(e *LogEntry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return errors.New("log output closed")
+	}
+	w, exists := this.writers[e.Type]
+	if !exists {
+		if this.writers == nil {
+			this.writers = make(map[string]*logWriter)
+		}
+		w = newLogWriter(this.core, e.Type)
+		this.writers[e.Type] = w
+	}
+	select {
+	case w.ch <- logLine{t: e.Time, b: e.Bytes(false)}:
+	default: //队列满，丢弃
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return nil
+}
+
+//等待全部类别写入文件，不持有锁，不影响WriteLog
+func (this *fileOutput) Flush() {
+	this.lock.Lock()
+	writers := make([]*logWriter, 0, len(this.writers))
+	for _, w := range this.writers {
+		writers = append(writers, w)
+	}
+	this.lock.Unlock()
+	for _, w := range writers {
+		c := make(chan struct{})
+		select {
+		case w.flushCh <- c:
+			select {
+			case <-c:
+			case <-w.done:
+			}
+		case <-w.done: //已关闭
+		}
+	}
+}
+
+func (this *fileOutput) Close() error {
+	this.lock.Lock()
+	this.closed = true
+	writers := this.writers
+	this.writers = nil
+	this.lock.Unlock()
+	for _, w := range writers {
+		close(w.ch)
+		<-w.done
+	}
+	return nil
+}
+
+type logLine struct {
+	t time.Time
+	b []byte
+}
+
+//一个日志类别的写入协程
+type logWriter struct {
+	core    *logCore
+	lType   string
+	ch      chan logLine
+	flushCh chan chan struct{} //flush请求，完成后关闭请求中的chan
+	done    chan struct{}
+	dropped int64      //丢弃的条数
+	archive sync.Mutex //切分出的文件依次压缩和清理
+
+	//以下只在写入协程中使用
+	file       *os.File
+	buf        *bufio.Writer
+	name       string //当前文件
+	size       int64
+	failTime   time.Time //最后一次写入失败的时间
+	reportTime time.Time //最后一次报告错误的时间
+	failed     int64     //写入失败丢弃的条数
+}
+
+func newLogWriter(core *logCore, lType string) *logWriter {
+	w := &logWriter{core: core, lType: lType, ch: make(chan logLine, logQueueSize), flushCh: make(chan chan struct{}), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (this *logWriter) run() {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case l, ok := <-this.ch:
+			if !ok {
+				this.flush()
+				this.closeFile()
+				this.report(nil)
+				close(this.done)
+				return
+			}
+			this.write(l)
+		case c := <-this.flushCh:
+			for n := len(this.ch); n > 0; n-- { //先写入请求之前已在队列中的日志
+				l, ok := <-this.ch
+				if !ok {
+					break
+				}
+				this.write(l)
+			}
+			this.flush()
+			close(c)
+		case <-ticker.C:
+			this.flush()
+			this.report(nil)
+		}
+	}
+}
+
+func (this *logWriter) settings() (path string, r LogRotate) {
+	this.core.lock.RLock()
+	defer this.core.lock.RUnlock()
+	return this.core.path, this.core.rotate
+}
+
+//按时间切分的文件名
+func (this *logWriter) fileName(path string, period string, t time.Time) string {
+	switch period {
+	case ROTATE_HOURLY:
+		return fmt.Sprintf("%s/%s_%s.log", path, this.lType, t.Format("2006010215"))
+	case ROTATE_NONE:
+		return fmt.Sprintf("%s/%s.log", path, this.lType)
+	}
+	return fmt.Sprintf("%s/%s_%s.log", path, this.lType, t.Format("20060102"))
+}
+
+func (this *logWriter) write(l logLine) {
+	path, r := this.settings()
+	name := this.fileName(path, r.Period, l.t)
+	if this.file != nil && name != this.name { //按时间切分(或目录改变)
+		old := this.name
+		this.closeFile()
+		go this.archiveFile(old, name, r)
+	}
+	if this.file != nil && r.MaxSize > 0 && this.size > 0 && this.size+int64(len(l.b)) > r.MaxSize { //按大小切分
+		old := this.name
+		this.closeFile()
+		backup := backupName(old)
+		if err := os.Rename(old, backup); err != nil {
+			this.fail(err)
+			return
+		}
+		go this.archiveFile(backup, old, r)
+	}
+	if this.file == nil {
+		if time.Since(this.failTime) < logRetryInterval {
+			this.failed++
+			return
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			this.fail(err)
+			return
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			this.fail(err)
+			return
+		}
+		this.file, this.name, this.size = f, name, stat.Size()
+		this.buf = bufio.NewWriterSize(f, logBufferSize)
+	}
+	n, err := this.buf.Write(l.b)
+	this.size += int64(n)
+	if err != nil {
+		this.fail(err)
+	}
+}
+
+func (this *logWriter) flush() {
+	if this.buf != nil && this.buf.Buffered() > 0 {
+		if err := this.buf.Flush(); err != nil {
+			this.fail(err)
+		}
+	}
+}
+
+func (this *logWriter) closeFile() {
+	if this.file == nil {
+		return
+	}
+	if err := this.buf.Flush(); err != nil {
+		this.fail(err)
+		return
+	}
+	this.file.Close()
+	this.file, this.buf = nil, nil
+}
+
+//写入失败：丢弃缓冲的内容，关闭文件，logRetryInterval后重新打开
+func (this *logWriter) fail(err error) {
+	if this.file != nil {
+		this.file.Close()
+		this.file, this.buf = nil, nil
+	}
+	this.failed++
+	this.failTime = time.Now()
+	this.report(err)
+}
+
+//报告写入错误和丢弃的条数，每logReportPeriod最多一次
+func (this *logWriter) report(err error) {
+	if (err == nil && this.failed == 0 && atomic.LoadInt64(&this.dropped) == 0) || time.Since(this.reportTime) < logReportPeriod {
+		return
+	}
+	dropped := atomic.SwapInt64(&this.dropped, 0) + this.failed
+	msg := fmt.Sprintf("log %s: %d lines dropped", this.lType, dropped)
+	if err != nil {
+		msg += ", write fail: " + err.Error()
+	}
+	fmt.Fprintln(os.Stderr, msg)
+	this.reportTime = time.Now()
+	this.failed = 0
+}
+
+//按大小切分时的文件名：type_20060102.log => type_20060102.1.log
+func backupName(name string) string {
+	base := strings.TrimSuffix(name, ".log")
+	for i := 1; ; i++ {
+		b := base + "." + strconv.Itoa(i) + ".log"
+		_, err1 := os.Stat(b)
+		_, err2 := os.Stat(b + ".gz")
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return b
+		}
+	}
+}
+
+//处理切分出的文件：压缩，并清理过期的文件，current为正在写入的文件(不清理)
+func (this *logWriter) archiveFile(name, current string, r LogRotate) {
+	this.archive.Lock()
+	defer this.archive.Unlock()
+	if r.Compress {
+		if err := gzipFile(name); err != nil && !os.IsNotExist(err) { //已被之前的清理删除
+			fmt.Fprintf(os.Stderr, "log %s: compress %s fail: %s\n", this.lType, name, err.Error())
+		}
+	}
+	if r.MaxBackups <= 0 && r.MaxAge <= 0 {
+		return
+	}
+	dir := filepath.Dir(name)
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(this.lType) + `(_\d+)?(\.\d+)?\.log(\.gz)?$`)
+	entries, _ := os.ReadDir(dir)
+	var files []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() || !re.MatchString(e.Name()) || filepath.Join(dir, e.Name()) == filepath.Clean(current) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for i, f := range files {
+		if (r.MaxBackups > 0 && i >= r.MaxBackups) || (r.MaxAge > 0 && time.Since(f.ModTime()) > r.MaxAge) {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+//压缩为name.gz并删除原文件
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	if stat, err := src.Stat(); err == nil { //保留原文件的修改时间，清理时按此排序
+		os.Chtimes(name+".gz", stat.ModTime(), stat.ModTime())
+	}
+	return os.Remove(name)
+}
@@ -2,7 +2,7 @@
 
 // 常用工具包
 //
-// 提供 benchmark,log处理，ini配置文件处理,数据校验validator，Md5等方法
+// 提供 benchmark,log处理，ini/yaml/toml/json配置文件处理,数据校验validator，Md5等方法
 package util
 
 import (
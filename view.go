@@ -0,0 +1,346 @@
+//模板处理：遍历views目录(含子目录)编译模板，支持布局继承(extends/block)和嵌套include
+//
+//	{{extends "layout/main.tpl"}}           继承布局，须写在模板开头，布局中用{{block "name" .}}定义可覆盖的区块
+//	{{define "name"}}...{{end}}             在子模板中覆盖布局的同名block
+//	{{#include "common/header.tpl"}}        引用子模板(路径相对views目录)，子模板中可继续include
+//
+//模板名称为相对views目录的路径，如 Render("user/list.tpl", data)
+//
+//可通过SetViewFS使用内嵌(embed.FS)的模板，磁盘上views目录存在的同名文件优先
+//
+//模板按扩展名交给不同的视图引擎处理：.txt/.text使用text/template(纯文本、邮件等)，
+//其它使用html/template，应用可通过AddViewEngine为扩展名指定自己的引擎(如markdown、pongo2等)
+
+package ecgo
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/tim1020/ecgo/util"
+	"html/template"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	ttemplate "text/template"
+)
+
+var (
+	reExtends = regexp.MustCompile(`\{\{\s*extends\s+"(.+?)"\s*\}\}`)
+	reInclude = regexp.MustCompile(`\{\{#include "(.+?)"\}\}`)
+)
+
+//模板不存在，视图引擎Render时找不到模板应返回(或包装)此错误
+var ErrViewNotFound = errors.New("template not found")
+
+//视图引擎接口
+type ViewEngine interface {
+	Load(fsys fs.FS, names []string) error                   //服务启动时载入(编译)names中的模板，names为相对views目录的路径
+	Reload(fsys fs.FS, names []string) error                 //模板文件变化时重新载入，失败时应保留原来的模板
+	Render(w io.Writer, name string, data interface{}) error //渲染模板
+}
+
+//模板源文件
+type tplFile struct {
+	name     string   //相对views目录的名称，如 user/list.tpl
+	content  string   //转换后的内容(去掉extends，include转为template调用)
+	extends  string   //继承的布局模板
+	includes []string //引用的子模板
+}
+
+//为扩展名(如".md")指定视图引擎，ext为空时设置缺省引擎，需在Run之前调用
+func (this *Application) AddViewEngine(ext string, e ViewEngine) {
+	this.viewEngines[ext] = e
+}
+
+//设置内嵌的模板文件系统(如 fs.Sub(assets, "views"))，需在Run之前调用
+func (this *Application) SetViewFS(fsys fs.FS) {
+	this.embedViews = fsys
+}
+
+//根椐模板扩展名选择视图引擎，未指定的扩展名使用缺省引擎
+func (this *Application) viewEngine(name string) ViewEngine {
+	if e, exists := this.viewEngines[path.Ext(name)]; exists {
+		return e
+	}
+	return this.viewEngines[""]
+}
+
+//编译全部模板：按扩展名分组后交给对应的视图引擎载入，引擎各自在全部成功时才替换正在使用的模板
+func (this *Application) buildTemplate() (err error) {
+	this.Log.Write(LL_SYS, "build template")
+	if !this.viewLoaded { //未指定引擎的扩展名使用内置引擎
+		funcs := this.tplFuncs()
+		html := &htmlEngine{funcs: funcs}
+		text := &textEngine{funcs: ttemplate.FuncMap(funcs)}
+		for _, ext := range []string{"", ".tpl", ".html", ".htm", ".txt", ".text"} {
+			if _, exists := this.viewEngines[ext]; !exists {
+				if ext == ".txt" || ext == ".text" {
+					this.viewEngines[ext] = text
+				} else {
+					this.viewEngines[ext] = html
+				}
+			}
+		}
+	}
+	fsys := newOverlayFS(viewPath, this.embedViews)
+	var errs []string
+	var engines []ViewEngine //按engines中的下标分组(引擎可能是不可比较的类型，不能作为map的key)
+	var groups [][]string
+	index := func(e ViewEngine) int {
+		for i, v := range engines {
+			if sameEngine(v, e) {
+				return i
+			}
+		}
+		engines, groups = append(engines, e), append(groups, nil)
+		return len(engines) - 1
+	}
+	for _, e := range this.viewEngines { //没有模板文件的引擎也需要载入，以清除已删除的模板
+		index(e)
+	}
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name != "." || !errors.Is(err, fs.ErrNotExist) { //目录不存在时没有模板
+				errs = append(errs, fmt.Sprintf("读取模板目录失败: path=%s, %s", name, err.Error()))
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			i := index(this.viewEngine(name))
+			groups[i] = append(groups[i], name)
+		}
+		return nil
+	})
+	for i, e := range engines {
+		names := groups[i]
+		if this.viewLoaded {
+			err = e.Reload(fsys, names)
+		} else {
+			err = e.Load(fsys, names)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	this.viewLoaded = true
+	if len(errs) > 0 { //有错
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+//是否同一个引擎，不可比较的引擎(如含map的struct值)视为不同，按各自的扩展名分组
+func sameEngine(a, b ViewEngine) (same bool) {
+	defer func() {
+		if recover() != nil { //字段中含不可比较的值
+			same = false
+		}
+	}()
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+//使用html/template的内置引擎
+type htmlEngine struct {
+	funcs template.FuncMap
+	lock  sync.RWMutex
+	tpls  map[string]*template.Template
+}
+
+func (this *htmlEngine) Load(fsys fs.FS, names []string) error {
+	return this.Reload(fsys, names)
+}
+
+func (this *htmlEngine) Reload(fsys fs.FS, names []string) error {
+	files, errs := readTplFiles(fsys)
+	tpls := make(map[string]*template.Template)
+	for _, name := range names {
+		chain, err := tplChain(name, files)
+		if err == nil {
+			t := template.New(chain[len(chain)-1]).Funcs(this.funcs)
+			if err = parseTplChain(&htmlSet{t}, chain, files); err == nil {
+				tpls[name] = t
+				continue
+			}
+		}
+		errs = append(errs, fmt.Sprintf("编译模板失败: file=%s, %s", name, err.Error()))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	this.lock.Lock()
+	this.tpls = tpls
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *htmlEngine) Render(w io.Writer, name string, data interface{}) error {
+	this.lock.RLock()
+	t, exists := this.tpls[name]
+	this.lock.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	return t.Execute(w, data)
+}
+
+//使用text/template的内置引擎，用于纯文本输出，不做html转义
+type textEngine struct {
+	funcs ttemplate.FuncMap
+	lock  sync.RWMutex
+	tpls  map[string]*ttemplate.Template
+}
+
+func (this *textEngine) Load(fsys fs.FS, names []string) error {
+	return this.Reload(fsys, names)
+}
+
+func (this *textEngine) Reload(fsys fs.FS, names []string) error {
+	files, errs := readTplFiles(fsys)
+	tpls := make(map[string]*ttemplate.Template)
+	for _, name := range names {
+		chain, err := tplChain(name, files)
+		if err == nil {
+			t := ttemplate.New(chain[len(chain)-1]).Funcs(this.funcs)
+			if err = parseTplChain(&textSet{t}, chain, files); err == nil {
+				tpls[name] = t
+				continue
+			}
+		}
+		errs = append(errs, fmt.Sprintf("编译模板失败: file=%s, %s", name, err.Error()))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	this.lock.Lock()
+	this.tpls = tpls
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *textEngine) Render(w io.Writer, name string, data interface{}) error {
+	this.lock.RLock()
+	t, exists := this.tpls[name]
+	this.lock.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	return t.Execute(w, data)
+}
+
+//一组关联的模板，最外层布局直接解析到根模板，其它文件作为关联模板
+type tplSet interface {
+	parse(name, content string) error
+}
+
+type htmlSet struct{ t *template.Template }
+
+func (this *htmlSet) parse(name, content string) (err error) {
+	nt := this.t
+	if name != nt.Name() {
+		nt = nt.New(name)
+	}
+	_, err = nt.Parse(content)
+	return
+}
+
+type textSet struct{ t *ttemplate.Template }
+
+func (this *textSet) parse(name, content string) (err error) {
+	nt := this.t
+	if name != nt.Name() {
+		nt = nt.New(name)
+	}
+	_, err = nt.Parse(content)
+	return
+}
+
+//遍历模板目录，读取所有模板文件
+func readTplFiles(fsys fs.FS) (files map[string]*tplFile, errs []string) {
+	files = make(map[string]*tplFile)
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("读取模板文件失败: file=%s", name))
+			return nil
+		}
+		files[name] = newTplFile(name, string(content))
+		return nil
+	})
+	return
+}
+
+//解析模板中的extends和include指令
+func newTplFile(name, content string) *tplFile {
+	f := &tplFile{name: name}
+	if m := reExtends.FindStringSubmatch(content); m != nil {
+		f.extends = m[1]
+		content = reExtends.ReplaceAllString(content, "")
+	}
+	for _, m := range reInclude.FindAllStringSubmatch(content, -1) {
+		f.includes = append(f.includes, m[1])
+	}
+	f.content = reInclude.ReplaceAllString(content, `{{template "$1" .}}`)
+	return f
+}
+
+//沿extends链找到最外层布局，返回从模板本身到最外层布局的列表
+func tplChain(name string, files map[string]*tplFile) (chain []string, err error) {
+	for n := name; n != ""; n = files[n].extends {
+		if _, exists := files[n]; !exists {
+			return nil, fmt.Errorf("extends file not found: %s", n)
+		}
+		for _, c := range chain {
+			if c == n {
+				return nil, fmt.Errorf("extends cycle: %s", strings.Join(append(chain, n), " -> "))
+			}
+		}
+		chain = append(chain, n)
+	}
+	return
+}
+
+//从最外层布局开始逐层解析，子模板中define的区块覆盖布局中的同名block
+func parseTplChain(set tplSet, chain []string, files map[string]*tplFile) error {
+	parsed := make(map[string]bool)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := parseTpl(set, chain[i], files, parsed, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//解析模板及其include的子模板(递归)，stack为当前的include路径，用于检测循环引用
+func parseTpl(set tplSet, name string, files map[string]*tplFile, parsed map[string]bool, stack []string) error {
+	for _, s := range stack {
+		if s == name {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(stack, name), " -> "))
+		}
+	}
+	if parsed[name] {
+		return nil
+	}
+	f, exists := files[name]
+	if !exists {
+		return fmt.Errorf("include file not found: %s", name)
+	}
+	stack = append(stack, name)
+	for _, inc := range f.includes {
+		if err := parseTpl(set, inc, files, parsed, stack); err != nil {
+			return err
+		}
+	}
+	if err := set.parse(name, f.content); err != nil {
+		return err
+	}
+	parsed[name] = true
+	return nil
+}
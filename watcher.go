@@ -0,0 +1,82 @@
+//文件监控：监听views和conf目录的变化(基于fsnotify)，合并短时间内的多次变化后重新编译模板和载入配置
+//
+//生产环境可设置 auto_reload=off 关闭
+
+package ecgo
+
+import (
+	"github.com/fsnotify/fsnotify"
+	. "github.com/tim1020/ecgo/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//启动监控协程
+func (this *Application) watch() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		this.Log.E("watcher start fail: %s", err.Error())
+		return
+	}
+	addWatchDir(w, viewPath)
+	addWatchDir(w, confPath) //include的文件可在子目录中
+	this.Log.Write(LL_SYS, "watcher start, views=%s, conf=%s", viewPath, confPath)
+	ms := this.ConfInt("auto_reload_delay", 300)
+	delay := time.Duration(ms) * time.Millisecond
+	go func() {
+		var fire <-chan time.Time
+		viewChanged, confChanged := false, false
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&fsnotify.Chmod == ev.Op {
+					continue
+				}
+				if ev.Op&fsnotify.Create != 0 { //新建的子目录也需要监控
+					if stat, err := os.Stat(ev.Name); err == nil && stat.IsDir() {
+						addWatchDir(w, ev.Name)
+					}
+				}
+				if strings.HasPrefix(ev.Name, filepath.Clean(viewPath)) {
+					viewChanged = true
+				} else {
+					confChanged = true
+				}
+				fire = time.After(delay) //延迟处理，合并连续的变化
+			case <-fire:
+				fire = nil
+				if confChanged {
+					this.reloadConf()
+				}
+				if viewChanged {
+					if err := this.buildTemplate(); err != nil {
+						for _, str := range strings.Split(err.Error(), "\n") {
+							this.Log.E("%s", str)
+						}
+					}
+				}
+				viewChanged, confChanged = false, false
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				this.Log.E("watcher error: %s", err.Error())
+			}
+		}
+	}()
+}
+
+//监控目录及其所有子目录
+func addWatchDir(w *fsnotify.Watcher, root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			w.Add(path)
+		}
+		return nil
+	})
+}